@@ -0,0 +1,130 @@
+package main
+
+/*
+ * RSS Download Tool
+ * Copyright (c) 2021 Aaron Turner  <aturner at synfin dot net>
+ *
+ * This program is free software: you can redistribute it
+ * and/or modify it under the terms of the GNU General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or with the authors permission any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/knadh/koanf"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	BREAKER_FAILURES = "CircuitBreaker.Failures"
+	BREAKER_COOLDOWN = "CircuitBreaker.Cooldown"
+
+	DEFAULT_BREAKER_FAILURES = 3
+	DEFAULT_BREAKER_COOLDOWN = time.Hour
+)
+
+// Calls fn for each of the feeds, carrying on after any errors.  Feeds
+// which have failed CircuitBreaker.Failures times in a row are skipped
+// for CircuitBreaker.Cooldown and then retried once before being skipped
+// again.  Returns all the errors combined.
+func processFeeds(konf *koanf.Koanf, cache *CacheFile, dryRun bool, feeds []string, fn func(string) error) error {
+	failed := []string{}
+	skipped := 0
+	for _, feedName := range feeds {
+		if until := cache.FeedOpenUntil(feedName); !until.IsZero() {
+			log.Warnf("Skipping %s until %s after %d failures", feedName,
+				until.Local().Format("2006-01-02 15:04"), cache.Feeds[feedName].Failures)
+			skipped++
+			continue
+		}
+		if health, ok := cache.Feeds[feedName]; ok && health.Tripped {
+			log.Infof("Retrying %s after %d failures", feedName, health.Failures)
+		}
+
+		err := fn(feedName)
+		if err == nil {
+			cache.FeedSucceeded(feedName)
+			continue
+		}
+
+		log.WithError(err).Errorf("Unable to process %s", feedName)
+		failed = append(failed, fmt.Sprintf("%s: %s", feedName, err))
+		if !dryRun {
+			PublishEvent(konf, cache, NewFeedErrorEvent(feedName, err))
+		}
+		if cache.FeedFailed(konf, feedName, err) && !dryRun {
+			health := cache.Feeds[feedName]
+			err = fmt.Errorf("Skipping %s until %s after %d failures in a row: %s", feedName,
+				health.OpenUntil.Local().Format("2006-01-02 15:04"), health.Failures, err)
+			if err = SendPushError(konf, err); err != nil {
+				log.WithError(err).Errorf("Unable to send error notification")
+			}
+		}
+	}
+
+	log.Infof("Processed %d feed(s): %d ok, %d failed, %d skipped",
+		len(feeds), len(feeds)-len(failed)-skipped, len(failed), skipped)
+	if len(failed) > 0 {
+		return fmt.Errorf("%d of %d feed(s) failed:\n%s", len(failed), len(feeds), strings.Join(failed, "\n"))
+	}
+	return nil
+}
+
+// Returns when the circuit breaker for the feed closes or the zero time
+// if the feed should be processed
+func (c *CacheFile) FeedOpenUntil(feedName string) time.Time {
+	health, ok := c.Feeds[feedName]
+	if !ok || health.OpenUntil.Before(time.Now()) {
+		return time.Time{}
+	}
+	return health.OpenUntil
+}
+
+func (c *CacheFile) FeedSucceeded(feedName string) {
+	delete(c.Feeds, feedName)
+}
+
+// Records the failure and returns true if it tripped the circuit breaker
+// for the first time since the feed last succeeded.  A failure while the
+// breaker is half open re-opens it for another cooldown.
+func (c *CacheFile) FeedFailed(konf *koanf.Koanf, feedName string, err error) bool {
+	health, ok := c.Feeds[feedName]
+	if !ok {
+		health = &FeedHealth{}
+		c.Feeds[feedName] = health
+	}
+	health.Failures++
+	health.LastError = err.Error()
+
+	failures := DEFAULT_BREAKER_FAILURES
+	if konf.Exists(BREAKER_FAILURES) {
+		failures = konf.Int(BREAKER_FAILURES)
+	}
+	cooldown := DEFAULT_BREAKER_COOLDOWN
+	if d := konf.Duration(BREAKER_COOLDOWN); d > 0 {
+		cooldown = d
+	}
+	if failures <= 0 || health.Failures < failures {
+		return false
+	}
+	health.OpenUntil = time.Now().Add(cooldown)
+	if health.Tripped {
+		log.Warnf("%s failed again, skipping until %s", feedName,
+			health.OpenUntil.Local().Format("2006-01-02 15:04"))
+		return false
+	}
+	health.Tripped = true
+	return true
+}
@@ -0,0 +1,133 @@
+package main
+
+/*
+ * RSS Download Tool
+ * Copyright (c) 2021 Aaron Turner  <aturner at synfin dot net>
+ *
+ * This program is free software: you can redistribute it
+ * and/or modify it under the terms of the GNU General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or with the authors permission any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// KB, MB, GB... are powers of 1024 as they always have been, which is
+// also what trackers mean by sizes like "1.37 GB"
+const (
+	B  = 1
+	KB = 1024 * B
+	MB = 1024 * KB
+	GB = 1024 * MB
+	TB = 1024 * GB
+	PB = 1024 * TB
+)
+
+// IEC units, the same sizes with an explicit name
+const (
+	KiB = KB
+	MiB = MB
+	GiB = GB
+	TiB = TB
+	PiB = PB
+)
+
+var BYTE_UNITS = map[string]uint64{
+	"":      B,
+	"b":     B,
+	"byte":  B,
+	"bytes": B,
+	"k":     KB,
+	"kb":    KB,
+	"m":     MB,
+	"mb":    MB,
+	"g":     GB,
+	"gb":    GB,
+	"t":     TB,
+	"tb":    TB,
+	"p":     PB,
+	"pb":    PB,
+	"ki":    KiB,
+	"kib":   KiB,
+	"mi":    MiB,
+	"mib":   MiB,
+	"gi":    GiB,
+	"gib":   GiB,
+	"ti":    TiB,
+	"tib":   TiB,
+	"pi":    PiB,
+	"pib":   PiB,
+}
+
+// units used by FormatBytes, largest first
+var FORMAT_UNITS = []struct {
+	name string
+	size uint64
+}{
+	{"PB", PB},
+	{"TB", TB},
+	{"GB", GB},
+	{"MB", MB},
+	{"KB", KB},
+}
+
+var BYTES_RE = regexp.MustCompile(`^\s*([0-9]*\.?[0-9]+)\s*([a-zA-Z]*)\s*$`)
+
+// Converts a string like "1.37 GB", "500MiB" or "1024" to a number of bytes.
+// Both KB, MB, GB... and KiB, MiB, GiB... are powers of 1024.  Units are
+// case-insensitive.
+func ParseBytes(str string) (uint64, error) {
+	if strings.TrimSpace(str) == "" {
+		return 0, nil
+	}
+	match := BYTES_RE.FindStringSubmatch(str)
+	if match == nil {
+		return 0, fmt.Errorf("Unparsable bytes string: %s", str)
+	}
+	unit, ok := BYTE_UNITS[strings.ToLower(match[2])]
+	if !ok {
+		return 0, fmt.Errorf("Unknown unit `%s` in bytes string: %s", match[2], str)
+	}
+
+	// avoid float rounding for whole numbers
+	if whole, err := strconv.ParseUint(match[1], 10, 64); err == nil {
+		if whole > math.MaxUint64/unit {
+			return 0, fmt.Errorf("Bytes string is too large: %s", str)
+		}
+		return whole * unit, nil
+	}
+
+	value, err := strconv.ParseFloat(match[1], 64)
+	if err != nil {
+		return 0, fmt.Errorf("Unparsable bytes string: %s", str)
+	}
+	bytes := math.Round(value * float64(unit))
+	if bytes >= math.MaxUint64 {
+		return 0, fmt.Errorf("Bytes string is too large: %s", str)
+	}
+	return uint64(bytes), nil
+}
+
+// Returns the number of bytes as a human readable string
+func FormatBytes(bytes uint64) string {
+	for _, unit := range FORMAT_UNITS {
+		if bytes >= unit.size {
+			return fmt.Sprintf("%.2f %s", float64(bytes)/float64(unit.size), unit.name)
+		}
+	}
+	return fmt.Sprintf("%d B", bytes)
+}
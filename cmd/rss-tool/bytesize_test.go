@@ -0,0 +1,135 @@
+package main
+
+/*
+ * RSS Download Tool
+ * Copyright (c) 2021 Aaron Turner  <aturner at synfin dot net>
+ *
+ * This program is free software: you can redistribute it
+ * and/or modify it under the terms of the GNU General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or with the authors permission any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+import (
+	"testing"
+)
+
+func TestParseBytes(t *testing.T) {
+	tests := []struct {
+		input string
+		bytes uint64
+		err   bool
+	}{
+		// plain numbers & empty
+		{"", 0, false},
+		{"   ", 0, false},
+		{"0", 0, false},
+		{"1024", 1024, false},
+		{"1.5", 2, false},
+		{"18446744073709551615", 18446744073709551615, false},
+
+		// KB, MB, GB... keep their original powers of 1024
+		{"1KB", 1024, false},
+		{"1k", 1024, false},
+		{"10GB", 10737418240, false},
+		{"1.37 GB", 1471026299, false},
+		{".5MB", 524288, false},
+		{"2TB", 2199023255552, false},
+		{"1PB", 1125899906842624, false},
+
+		// IEC units are the same sizes
+		{"1KiB", 1024, false},
+		{"500MiB", 500 * 1024 * 1024, false},
+		{"1.5 GiB", 1610612736, false},
+		{"1Ti", 1024 * 1024 * 1024 * 1024, false},
+
+		// case & spaces
+		{"10gb", 10 * GB, false},
+		{"10 Gb", 10 * GB, false},
+		{" 10 GB ", 10 * GB, false},
+		{"10GIB", 10 * GiB, false},
+		{"100 bytes", 100, false},
+		{"100B", 100, false},
+
+		// overflow
+		{"18446744073709551616", 0, true},
+		{"20000000 TB", 0, true},
+		{"18446.8 PB", 0, true},
+
+		// rejected
+		{"1e3", 0, true},
+		{"-1", 0, true},
+		{"+1", 0, true},
+		{"1,000", 0, true},
+		{"1.2.3", 0, true},
+		{"GB", 0, true},
+		{"10 XB", 0, true},
+		{"10 G B", 0, true},
+		{"1TBTB", 0, true},
+	}
+
+	for _, test := range tests {
+		bytes, err := ParseBytes(test.input)
+		if test.err {
+			if err == nil {
+				t.Errorf("ParseBytes(%q) = %d, expected an error", test.input, bytes)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseBytes(%q) returned error: %s", test.input, err)
+		} else if bytes != test.bytes {
+			t.Errorf("ParseBytes(%q) = %d, expected %d", test.input, bytes, test.bytes)
+		}
+	}
+}
+
+func TestFormatBytes(t *testing.T) {
+	tests := []struct {
+		bytes  uint64
+		output string
+	}{
+		{0, "0 B"},
+		{999, "999 B"},
+		{1023, "1023 B"},
+		{1024, "1.00 KB"},
+		{1536000, "1.46 MB"},
+		{10 * GB, "10.00 GB"},
+		{10000000000, "9.31 GB"},
+		{2 * TB, "2.00 TB"},
+		{3 * PB, "3.00 PB"},
+		{18446744073709551615, "16384.00 PB"},
+	}
+
+	for _, test := range tests {
+		if output := FormatBytes(test.bytes); output != test.output {
+			t.Errorf("FormatBytes(%d) = %q, expected %q", test.bytes, output, test.output)
+		}
+	}
+}
+
+// FormatBytes output should parse back to about the same size
+func TestFormatParseBytes(t *testing.T) {
+	for _, bytes := range []uint64{0, 1, 999, 1000, 123456789, 10 * GiB, 5 * TB} {
+		parsed, err := ParseBytes(FormatBytes(bytes))
+		if err != nil {
+			t.Errorf("ParseBytes(FormatBytes(%d)) returned error: %s", bytes, err)
+			continue
+		}
+		diff := float64(parsed) - float64(bytes)
+		if diff < 0 {
+			diff = -diff
+		}
+		if diff > float64(bytes)*0.005 {
+			t.Errorf("ParseBytes(FormatBytes(%d)) = %d", bytes, parsed)
+		}
+	}
+}
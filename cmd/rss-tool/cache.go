@@ -20,54 +20,192 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io/ioutil"
+	"os"
+	"path/filepath"
 	"time"
 
+	"github.com/knadh/koanf"
 	log "github.com/sirupsen/logrus"
+	syscall "golang.org/x/sys/unix"
 )
 
 const (
-	ERROR_HOLD_DOWN = 4 // hours
+	ERROR_HOLD_DOWN            = 4 // hours, default for ErrorPolicy.HoldDown
+	CACHE_LOCK_TIMEOUT         = "CacheLockTimeout"
+	DEFAULT_CACHE_LOCK_TIMEOUT = time.Minute
+	CACHE_LOCK_POLL            = 100 * time.Millisecond
 )
 
 type CacheFile struct {
-	filename string
-	Entries  []RssFeedEntry   `json:"Entries"`
-	Errors   map[string]int64 `json:"Errors"`
+	filename   string
+	lock       *os.File
+	published  []WebhookEvent          // waiting to be sent to the webhooks
+	Entries    []RssFeedEntry          `json:"Entries"`
+	Errors     map[string]*ErrorRecord `json:"Errors"`
+	Deferred   []RssFeedEntry          `json:"Deferred"` // waiting for free disk space
+	Feeds      map[string]*FeedHealth  `json:"Feeds"`    // for the circuit breaker
+	Digest     []DigestEntry           `json:"Digest"`   // matches waiting to be sent in a digest
+	Held       []HeldMessage           `json:"Held"`     // notifications held by quiet hours & rate limits
+	Sent       map[string][]time.Time  `json:"Sent"`     // notifications sent in the last hour for rate limits
+	Activity   []WebhookEvent          `json:"Activity"` // since the last report
+	LastReport time.Time               `json:"LastReport"`
 }
 
-func OpenCache(path string) (*CacheFile, error) {
+// Tracks consecutive failures of a feed
+type FeedHealth struct {
+	Failures  int       `json:"Failures"`
+	LastError string    `json:"LastError"`
+	OpenUntil time.Time `json:"OpenUntil"` // feed is skipped until then
+	Tripped   bool      `json:"Tripped"`   // breaker opened since the last success
+}
+
+// Returns how long to wait for another process to release the cache
+func CacheLockTimeout(konf *koanf.Koanf) time.Duration {
+	if timeout := konf.Duration(CACHE_LOCK_TIMEOUT); timeout > 0 {
+		return timeout
+	}
+	return DEFAULT_CACHE_LOCK_TIMEOUT
+}
+
+// Locks and reads the cache.  The lock is held until Close() so nothing
+// else can update the cache until we have saved our changes.
+func OpenCache(path string, timeout time.Duration) (*CacheFile, error) {
 	cache := CacheFile{
-		Entries: []RssFeedEntry{},
-		Errors:  map[string]int64{},
+		Entries:  []RssFeedEntry{},
+		Errors:   map[string]*ErrorRecord{},
+		Deferred: []RssFeedEntry{},
+		Feeds:    map[string]*FeedHealth{},
+		Digest:   []DigestEntry{},
+		Held:     []HeldMessage{},
+		Sent:     map[string][]time.Time{},
+		Activity: []WebhookEvent{},
 	}
 	cacheFile := GetPath(path)
+	lock, err := lockFile(cacheFile+".lock", timeout)
+	if err != nil {
+		return &cache, err
+	}
+	cache.lock = lock
+
 	cacheBytes, err := ioutil.ReadFile(cacheFile)
 	if err != nil {
 		log.Warnf("Creating new cache file: %s", cacheFile)
 	} else {
 		if err = json.Unmarshal(cacheBytes, &cache); err != nil {
+			cache.Close()
 			return &cache, err
 		}
 	}
+	if cache.Deferred == nil {
+		cache.Deferred = []RssFeedEntry{}
+	}
+	if cache.Errors == nil {
+		cache.Errors = map[string]*ErrorRecord{}
+	}
+	if cache.Feeds == nil {
+		cache.Feeds = map[string]*FeedHealth{}
+	}
+	if cache.Digest == nil {
+		cache.Digest = []DigestEntry{}
+	}
+	if cache.Held == nil {
+		cache.Held = []HeldMessage{}
+	}
+	if cache.Sent == nil {
+		cache.Sent = map[string][]time.Time{}
+	}
+	if cache.Activity == nil {
+		cache.Activity = []WebhookEvent{}
+	}
 	cache.filename = cacheFile
 	return &cache, nil
 }
 
+// Writes the cache to a temp file which replaces the cache so we never
+// leave a partially written cache behind
 func (c *CacheFile) SaveCache() error {
 	cacheBytes, _ := json.MarshalIndent(*c, "", "  ")
-	return ioutil.WriteFile(c.filename, cacheBytes, 0644)
+	tmp, err := ioutil.TempFile(filepath.Dir(c.filename), "."+filepath.Base(c.filename)+"-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err = tmp.Write(cacheBytes); err == nil {
+		err = tmp.Sync()
+	}
+	if err == nil {
+		err = tmp.Chmod(0644)
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), c.filename)
 }
 
-// returns true if the error for the given entry is 'new'
-func (c *CacheFile) CheckNewError(entry string) bool {
-	expire, ok := c.Errors[entry]
-	if ok {
-		return expire < time.Now().Unix()
+// Releases our lock on the cache
+func (c *CacheFile) Close() {
+	if c.lock == nil {
+		return
 	}
-	return true
+	if err := syscall.Flock(int(c.lock.Fd()), syscall.LOCK_UN); err != nil {
+		log.WithError(err).Errorf("Unable to unlock %s", c.lock.Name())
+	}
+	c.lock.Close()
+	c.lock = nil
 }
 
-func (c *CacheFile) AddError(entry string) {
-	c.Errors[entry] = time.Now().Add(time.Hour * ERROR_HOLD_DOWN).Unix()
+// Takes an exclusive advisory lock on path, waiting up to timeout for
+// any other process holding it
+func lockFile(path string, timeout time.Duration) (*os.File, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to open lock %s: %s", path, err)
+	}
+
+	deadline := time.Now().Add(timeout)
+	logged := false
+	for {
+		err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if err == nil {
+			return f, nil
+		}
+		if !errors.Is(err, syscall.EWOULDBLOCK) {
+			f.Close()
+			return nil, fmt.Errorf("Unable to lock %s: %s", path, err)
+		}
+		if time.Now().After(deadline) {
+			f.Close()
+			return nil, fmt.Errorf("Timed out after %s waiting for lock %s", timeout, path)
+		}
+		if !logged {
+			log.Infof("Waiting for another process to release %s", path)
+			logged = true
+		}
+		time.Sleep(CACHE_LOCK_POLL)
+	}
+}
+
+// Adds the entry to the queue of entries waiting for disk space
+func (c *CacheFile) AddDeferred(entry RssFeedEntry) {
+	if !RssFeedEntryExits(c.Deferred, entry) {
+		c.Deferred = append(c.Deferred, entry)
+	}
+}
+
+// Removes the entry from the queue of entries waiting for disk space
+func (c *CacheFile) RemoveDeferred(entry RssFeedEntry) {
+	deferred := []RssFeedEntry{}
+	for _, e := range c.Deferred {
+		if e.Title != entry.Title {
+			deferred = append(deferred, e)
+		}
+	}
+	c.Deferred = deferred
 }
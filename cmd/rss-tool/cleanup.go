@@ -0,0 +1,561 @@
+package main
+
+/*
+ * RSS Download Tool
+ * Copyright (c) 2021 Aaron Turner  <aturner at synfin dot net>
+ *
+ * This program is free software: you can redistribute it
+ * and/or modify it under the terms of the GNU General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or with the authors permission any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/knadh/koanf"
+	log "github.com/sirupsen/logrus"
+	syscall "golang.org/x/sys/unix"
+)
+
+const (
+	RETENTION         = "Retention"
+	CLEANUP_INTERVAL  = "CleanupInterval"
+	RETENTION_ACTIONS = "delete,move,client"
+)
+
+// How long to keep completed downloads on a target
+type RetentionPolicy struct {
+	MaxAge      string `koanf:"MaxAge"`      // remove anything older than this duration
+	MaxSize     string `koanf:"MaxSize"`     // remove the oldest until the total is below this
+	KeepLast    int    `koanf:"KeepLast"`    // number of episodes to keep for each series
+	TargetAvail string `koanf:"TargetAvail"` // remove the oldest until DiskStatus.Avail is this
+	Action      string `koanf:"Action"`      // delete, move or client
+	MoveTo      string `koanf:"MoveTo"`      // directory for the move action
+	Path        string `koanf:"Path"`        // directory whose entries may be removed
+}
+
+type CleanupCmd struct {
+	Target string `kong:"arg,optional,name='target',help='Only clean up this download target'"`
+	DryRun bool   `kong:"help='Only show what would be removed'"`
+}
+
+// A completed download on a target
+type cleanupItem struct {
+	Name     string
+	Path     string
+	Size     uint64
+	Modified time.Time
+	Reason   string
+	torrents []ClientTorrent
+}
+
+func (cc *CleanupCmd) Run(ctx *RunContext) error {
+	removed, err := Cleanup(ctx.Konf, cc.Target, cc.DryRun)
+	if err != nil {
+		return err
+	}
+	if len(removed) == 0 {
+		log.Infof("Nothing to clean up")
+	}
+	return nil
+}
+
+// Applies the retention policy of each target and returns what was removed
+func Cleanup(konf *koanf.Koanf, targetName string, dryRun bool) ([]cleanupItem, error) {
+	targets, err := LoadTargets(konf)
+	if err != nil {
+		return []cleanupItem{}, err
+	}
+	client, err := NewTorrentClient(konf)
+	if err != nil {
+		return []cleanupItem{}, err
+	}
+
+	removed := []cleanupItem{}
+	errs := []string{}
+	found := false
+	for _, target := range targets {
+		if targetName != "" && target.Name != targetName {
+			continue
+		}
+		found = true
+		policy, err := target.GetRetention(konf)
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		if policy == nil {
+			log.Debugf("No %s for %s", RETENTION, target.DiskPath)
+			continue
+		}
+
+		items, err := cleanupItems(target, policy, client)
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		disk, err := target.DiskUsage()
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		expired, err := policy.Expired(items, disk)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %s", target.DiskPath, err))
+			continue
+		}
+
+		for _, item := range expired {
+			if !policy.Removable(item) {
+				log.Infof("Leaving %s which isn't in the torrent client", item.Path)
+				continue
+			}
+			if dryRun {
+				log.Infof("Would remove %s (%s, %s)", item.Path, FormatBytes(item.Size), item.Reason)
+				removed = append(removed, item)
+				continue
+			}
+			log.Infof("Removing %s (%s, %s)", item.Path, FormatBytes(item.Size), item.Reason)
+			ok, err := policy.Remove(item, client)
+			if err != nil {
+				log.WithError(err).Errorf("Unable to remove %s", item.Path)
+				errs = append(errs, err.Error())
+			}
+			if ok {
+				removed = append(removed, item)
+			}
+		}
+	}
+	if targetName != "" && !found {
+		return removed, fmt.Errorf("Unknown download target: %s", targetName)
+	}
+
+	if !dryRun && len(removed) > 0 {
+		if err := SendPushText(konf, "RSS Cleanup", cleanupSummary(removed)); err != nil {
+			log.WithError(err).Errorf("Unable to send cleanup summary")
+		}
+	}
+	if len(errs) > 0 {
+		return removed, fmt.Errorf("Cleanup failed: %s", strings.Join(errs, "; "))
+	}
+	return removed, nil
+}
+
+// Returns a summary of what was removed for our notification
+func cleanupSummary(removed []cleanupItem) string {
+	var total uint64
+	lines := []string{}
+	for _, item := range removed {
+		total += item.Size
+		lines = append(lines, fmt.Sprintf("%s (%s, %s)", item.Name, FormatBytes(item.Size), item.Reason))
+	}
+	return fmt.Sprintf("Removed %d item(s), freeing %s:\n\n%s",
+		len(removed), FormatBytes(total), strings.Join(lines, "\n"))
+}
+
+// Returns the retention policy for the target or nil if there isn't one.
+// Without any `Targets` the global Retention is used.
+func (t *DownloadTarget) GetRetention(konf *koanf.Koanf) (*RetentionPolicy, error) {
+	key := RETENTION
+	if t.Name != "" {
+		key = fmt.Sprintf("%s.%s.%s", TARGETS, t.Name, RETENTION)
+	}
+	if !konf.Exists(key) {
+		return nil, nil
+	}
+	policy := RetentionPolicy{}
+	if err := konf.Unmarshal(key, &policy); err != nil {
+		return nil, fmt.Errorf("Unable to load %s: %s", key, err)
+	}
+	if err := policy.Validate(); err != nil {
+		return nil, fmt.Errorf("%s.%s", key, err)
+	}
+	return &policy, nil
+}
+
+// Returns an error if the policy is invalid
+func (rp *RetentionPolicy) Validate() error {
+	if rp.MaxAge != "" {
+		if _, err := time.ParseDuration(rp.MaxAge); err != nil {
+			return fmt.Errorf("MaxAge: %s", err)
+		}
+	}
+	if _, err := ParseBytes(rp.MaxSize); err != nil {
+		return fmt.Errorf("MaxSize: %s", err)
+	}
+	if _, err := ParseBytes(rp.TargetAvail); err != nil {
+		return fmt.Errorf("TargetAvail: %s", err)
+	}
+	if rp.KeepLast < 0 {
+		return fmt.Errorf("KeepLast: must not be negative")
+	}
+	if rp.Path != "" {
+		if !filepath.IsAbs(rp.Path) {
+			return fmt.Errorf("Path: must be an absolute path")
+		}
+		if info, err := os.Stat(rp.Path); err != nil {
+			return fmt.Errorf("Path: %s", err)
+		} else if !info.IsDir() {
+			return fmt.Errorf("Path: %s is not a directory", rp.Path)
+		}
+	}
+	switch rp.Action {
+	case "", "delete", "client":
+	case "move":
+		if rp.MoveTo == "" {
+			return fmt.Errorf("MoveTo: required for the move Action")
+		}
+		if err := checkWritableDir(rp.MoveTo); err != nil {
+			return fmt.Errorf("MoveTo: %s", err)
+		}
+	default:
+		return fmt.Errorf("Action: invalid %s, must be one of %s", rp.Action, RETENTION_ACTIONS)
+	}
+	return nil
+}
+
+// Returns the completed downloads on the target, oldest first.  Only the
+// torrents the client saved under the target's DiskPath and the entries of
+// the policy's Path are considered; the rest of DiskPath is never touched.
+// Anything still downloading, partial files and torrent files are skipped.
+func cleanupItems(target DownloadTarget, policy *RetentionPolicy, client TorrentClient) ([]cleanupItem, error) {
+	items := []cleanupItem{}
+	tracked := map[string]int{}
+	clientPaths := []string{}
+
+	if client != nil {
+		torrents, err := client.Torrents()
+		if err != nil {
+			return items, err
+		}
+		incomplete := map[string]bool{}
+		for _, t := range torrents {
+			if t.Name == "" || t.DownloadDir == "" {
+				continue
+			}
+			path := filepath.Join(t.DownloadDir, t.Name)
+			clientPaths = append(clientPaths, path)
+			if !isSubPath(target.DiskPath, path) || path == filepath.Clean(target.DiskPath) {
+				continue
+			}
+			if i, ok := tracked[path]; ok {
+				items[i].torrents = append(items[i].torrents, t)
+			} else {
+				tracked[path] = len(items)
+				items = append(items, cleanupItem{
+					Name:     t.Name,
+					Path:     path,
+					torrents: []ClientTorrent{t},
+				})
+			}
+			incomplete[path] = incomplete[path] || t.LeftUntilDone > 0
+		}
+
+		complete := []cleanupItem{}
+		for _, item := range items {
+			if incomplete[item.Path] {
+				log.Debugf("Skipping %s which is still downloading", item.Path)
+				continue
+			}
+			file, err := os.Stat(item.Path)
+			if os.IsNotExist(err) {
+				log.Debugf("Skipping %s which is no longer on disk", item.Path)
+				continue
+			} else if err != nil {
+				return []cleanupItem{}, err
+			}
+			if item.Size, err = itemSize(item.Path, file); err != nil {
+				return []cleanupItem{}, err
+			}
+			item.Modified = file.ModTime()
+			complete = append(complete, item)
+		}
+		items = complete
+	}
+
+	if policy.Path != "" {
+		files, err := ioutil.ReadDir(policy.Path)
+		if err != nil {
+			return []cleanupItem{}, err
+		}
+		for _, file := range files {
+			name := file.Name()
+			path := filepath.Join(policy.Path, name)
+			if name == "lost+found" || strings.HasSuffix(name, ".part") || strings.HasSuffix(name, ".torrent") {
+				continue
+			}
+			if target.DownloadPath != "" && isSubPath(path, target.DownloadPath) {
+				continue
+			}
+			if _, ok := tracked[path]; ok {
+				continue
+			}
+			if overlapsTorrent(path, clientPaths) {
+				log.Debugf("Skipping %s which the torrent client still has", path)
+				continue
+			}
+			size, err := itemSize(path, file)
+			if err != nil {
+				return []cleanupItem{}, err
+			}
+			items = append(items, cleanupItem{
+				Name:     name,
+				Path:     path,
+				Size:     size,
+				Modified: file.ModTime(),
+			})
+		}
+	}
+
+	if client == nil && policy.Path == "" {
+		log.Warnf("%s for %s needs a torrent client or a Path to know what to remove",
+			RETENTION, target.DiskPath)
+	}
+
+	sort.SliceStable(items, func(i, j int) bool {
+		return items[i].Modified.Before(items[j].Modified)
+	})
+	return items, nil
+}
+
+// Returns the size of a file or directory
+func itemSize(path string, file os.FileInfo) (uint64, error) {
+	if !file.IsDir() {
+		return uint64(file.Size()), nil
+	}
+	size, err := GetDirectorySize(path, file)
+	if err != nil {
+		return 0, fmt.Errorf("Unable to get directory size %s: %s", path, err)
+	}
+	return size, nil
+}
+
+// Returns true if path is inside one of the torrent paths or holds one
+func overlapsTorrent(path string, torrentPaths []string) bool {
+	for _, t := range torrentPaths {
+		if isSubPath(path, t) || isSubPath(t, path) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the items which should be removed, oldest first
+func (rp *RetentionPolicy) Expired(items []cleanupItem, disk DiskStatus) ([]cleanupItem, error) {
+	reasons := map[string]string{}
+
+	if rp.MaxAge != "" {
+		maxAge, err := time.ParseDuration(rp.MaxAge)
+		if err != nil {
+			return []cleanupItem{}, err
+		}
+		for _, item := range items {
+			if time.Since(item.Modified) > maxAge {
+				reasons[item.Path] = fmt.Sprintf("older than %s", rp.MaxAge)
+			}
+		}
+	}
+
+	if rp.KeepLast > 0 {
+		seen := map[string]int{}
+		// newest first
+		for i := len(items) - 1; i >= 0; i-- {
+			series := SeriesName(items[i].Name)
+			if series == "" {
+				continue
+			}
+			seen[series]++
+			if seen[series] > rp.KeepLast && reasons[items[i].Path] == "" {
+				reasons[items[i].Path] = fmt.Sprintf("more than %d of %s", rp.KeepLast, series)
+			}
+		}
+	}
+
+	maxSize, err := ParseBytes(rp.MaxSize)
+	if err != nil {
+		return []cleanupItem{}, err
+	}
+	if maxSize > 0 {
+		var total uint64
+		for _, item := range items {
+			if reasons[item.Path] == "" {
+				total += item.Size
+			}
+		}
+		for _, item := range items {
+			if total <= maxSize {
+				break
+			}
+			if reasons[item.Path] == "" {
+				reasons[item.Path] = fmt.Sprintf("over MaxSize %s", rp.MaxSize)
+				total -= item.Size
+			}
+		}
+	}
+
+	targetAvail, err := ParseBytes(rp.TargetAvail)
+	if err != nil {
+		return []cleanupItem{}, err
+	}
+	if targetAvail > 0 {
+		avail := disk.Avail
+		for _, item := range items {
+			if reasons[item.Path] != "" {
+				avail += item.Size
+			}
+		}
+		for _, item := range items {
+			if avail >= targetAvail {
+				break
+			}
+			if reasons[item.Path] == "" {
+				reasons[item.Path] = fmt.Sprintf("below TargetAvail %s", rp.TargetAvail)
+				avail += item.Size
+			}
+		}
+	}
+
+	expired := []cleanupItem{}
+	for _, item := range items {
+		if reason := reasons[item.Path]; reason != "" {
+			item.Reason = reason
+			expired = append(expired, item)
+		}
+	}
+	return expired, nil
+}
+
+// Returns if the policy's Action can remove the item.  The client Action
+// only removes what the torrent client knows about.
+func (rp *RetentionPolicy) Removable(item cleanupItem) bool {
+	return rp.Action != "client" || len(item.torrents) > 0
+}
+
+// Removes the item using the policy's Action and returns if it was removed.
+// Anything the torrent client still tracks is removed through the client
+// instead of from the disk so it doesn't keep seeding files which are gone.
+func (rp *RetentionPolicy) Remove(item cleanupItem, client TorrentClient) (bool, error) {
+	if !rp.Removable(item) {
+		return false, nil
+	}
+	ids := []int64{}
+	for _, t := range item.torrents {
+		ids = append(ids, t.Id)
+	}
+	if len(ids) > 0 && client == nil {
+		return false, fmt.Errorf("No torrent client configured to remove %s", item.Name)
+	}
+
+	switch rp.Action {
+	case "move":
+		if err := moveFile(item.Path, filepath.Join(rp.MoveTo, item.Name)); err != nil {
+			return false, err
+		}
+		if len(ids) > 0 {
+			// the files are already moved, so only the torrent is removed
+			if err := client.Remove(ids, false); err != nil {
+				return true, fmt.Errorf("Moved %s but unable to remove it from the torrent client: %s", item.Name, err)
+			}
+		}
+		return true, nil
+	case "client":
+		return true, client.Remove(ids, true)
+	default:
+		if len(ids) > 0 {
+			if err := client.Remove(ids, true); err != nil {
+				return false, err
+			}
+			return true, nil
+		}
+		if err := os.RemoveAll(item.Path); err != nil {
+			return false, err
+		}
+		return true, nil
+	}
+}
+
+// Moves the file or directory, copying it when dst is on another filesystem
+func moveFile(src, dst string) error {
+	if _, err := os.Lstat(dst); err == nil {
+		return fmt.Errorf("Unable to move %s: %s already exists", src, dst)
+	}
+	err := os.Rename(src, dst)
+	if !errors.Is(err, syscall.EXDEV) {
+		return err
+	}
+	if err = copyTree(src, dst); err != nil {
+		os.RemoveAll(dst)
+		return fmt.Errorf("Unable to copy %s to %s: %s", src, dst, err)
+	}
+	return os.RemoveAll(src)
+}
+
+// Copies the file, directory or symlink at src to dst
+func copyTree(src, dst string) error {
+	info, err := os.Lstat(src)
+	if err != nil {
+		return err
+	}
+	switch {
+	case info.Mode()&os.ModeSymlink != 0:
+		link, err := os.Readlink(src)
+		if err != nil {
+			return err
+		}
+		return os.Symlink(link, dst)
+	case info.IsDir():
+		if err = os.Mkdir(dst, info.Mode().Perm()); err != nil {
+			return err
+		}
+		files, err := ioutil.ReadDir(src)
+		if err != nil {
+			return err
+		}
+		for _, file := range files {
+			if err = copyTree(filepath.Join(src, file.Name()), filepath.Join(dst, file.Name())); err != nil {
+				return err
+			}
+		}
+	default:
+		if err = copyFile(src, dst, info.Mode().Perm()); err != nil {
+			return err
+		}
+	}
+	return os.Chtimes(dst, info.ModTime(), info.ModTime())
+}
+
+func copyFile(src, dst string, perm os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(out, in); err == nil {
+		err = out.Sync()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
@@ -0,0 +1,90 @@
+package main
+
+/*
+ * RSS Download Tool
+ * Copyright (c) 2021 Aaron Turner  <aturner at synfin dot net>
+ *
+ * This program is free software: you can redistribute it
+ * and/or modify it under the terms of the GNU General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or with the authors permission any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRetentionPolicyExpired(t *testing.T) {
+	now := time.Now()
+	// oldest first, as cleanupItems returns them
+	items := []cleanupItem{
+		{Name: "Show.Name.S01E01.1080p", Path: "/d/1", Size: 4 * GB, Modified: now.Add(-40 * 24 * time.Hour)},
+		{Name: "Movie.2020.1080p", Path: "/d/2", Size: 8 * GB, Modified: now.Add(-20 * 24 * time.Hour)},
+		{Name: "Show.Name.S01E02.1080p", Path: "/d/3", Size: 4 * GB, Modified: now.Add(-10 * 24 * time.Hour)},
+		{Name: "Show.Name.S01E03.1080p", Path: "/d/4", Size: 4 * GB, Modified: now.Add(-5 * 24 * time.Hour)},
+		{Name: "Other.Show.S02E01.720p", Path: "/d/5", Size: 2 * GB, Modified: now.Add(-time.Hour)},
+	}
+
+	tests := []struct {
+		name    string
+		policy  RetentionPolicy
+		avail   uint64
+		expired []string // Path:Reason prefix
+		err     bool
+	}{
+		{"nothing", RetentionPolicy{}, 0, []string{}, false},
+		{"MaxAge", RetentionPolicy{MaxAge: "360h"}, 0,
+			[]string{"/d/1:older than", "/d/2:older than"}, false},
+		{"KeepLast", RetentionPolicy{KeepLast: 1}, 0,
+			[]string{"/d/1:more than 1 of Show Name", "/d/3:more than 1 of Show Name"}, false},
+		{"KeepLast all", RetentionPolicy{KeepLast: 3}, 0, []string{}, false},
+		{"MaxSize", RetentionPolicy{MaxSize: "12GB"}, 0,
+			[]string{"/d/1:over MaxSize", "/d/2:over MaxSize"}, false},
+		// items already expired by MaxAge count towards MaxSize
+		{"MaxAge & MaxSize", RetentionPolicy{MaxAge: "720h", MaxSize: "8GB"}, 0,
+			[]string{"/d/1:older than", "/d/2:over MaxSize", "/d/3:over MaxSize"}, false},
+		{"TargetAvail", RetentionPolicy{TargetAvail: "10GB"}, 1 * GB,
+			[]string{"/d/1:below TargetAvail", "/d/2:below TargetAvail"}, false},
+		{"TargetAvail met", RetentionPolicy{TargetAvail: "10GB"}, 20 * GB, []string{}, false},
+		{"TargetAvail & MaxAge", RetentionPolicy{MaxAge: "720h", TargetAvail: "10GB"}, 1 * GB,
+			[]string{"/d/1:older than", "/d/2:below TargetAvail"}, false},
+		{"bad MaxAge", RetentionPolicy{MaxAge: "30 days"}, 0, nil, true},
+		{"bad MaxSize", RetentionPolicy{MaxSize: "lots"}, 0, nil, true},
+		{"bad TargetAvail", RetentionPolicy{TargetAvail: "lots"}, 0, nil, true},
+	}
+
+	for _, test := range tests {
+		expired, err := test.policy.Expired(items, DiskStatus{Avail: test.avail})
+		if test.err {
+			if err == nil {
+				t.Errorf("%s: expected an error", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: returned error: %s", test.name, err)
+			continue
+		}
+		got := []string{}
+		for _, item := range expired {
+			got = append(got, item.Path+":"+item.Reason)
+		}
+		ok := len(got) == len(test.expired)
+		for i := 0; ok && i < len(got); i++ {
+			ok = strings.HasPrefix(got[i], test.expired[i])
+		}
+		if !ok {
+			t.Errorf("%s: Expired() = %v, expected %v", test.name, got, test.expired)
+		}
+	}
+}
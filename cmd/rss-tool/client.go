@@ -0,0 +1,83 @@
+package main
+
+/*
+ * RSS Download Tool
+ * Copyright (c) 2021 Aaron Turner  <aturner at synfin dot net>
+ *
+ * This program is free software: you can redistribute it
+ * and/or modify it under the terms of the GNU General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or with the authors permission any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/knadh/koanf"
+)
+
+const (
+	CLIENT_TYPE     = "Client.Type"
+	CLIENT_URL      = "Client.Url"
+	CLIENT_USERNAME = "Client.Username"
+	CLIENT_PASSWORD = "Client.Password"
+)
+
+// A torrent as reported by the torrent client
+type ClientTorrent struct {
+	Id            int64
+	Name          string
+	DownloadDir   string
+	SizeWhenDone  uint64
+	LeftUntilDone uint64
+}
+
+// Interface to the torrent client downloading our torrents
+type TorrentClient interface {
+	Torrents() ([]ClientTorrent, error)
+	Remove(ids []int64, deleteData bool) error
+}
+
+// Returns the configured torrent client or nil if there isn't one
+func NewTorrentClient(konf *koanf.Koanf) (TorrentClient, error) {
+	switch clientType := konf.String(CLIENT_TYPE); strings.ToLower(clientType) {
+	case "":
+		return nil, nil
+	case "transmission":
+		return NewTransmissionClient(konf.String(CLIENT_URL),
+			konf.String(CLIENT_USERNAME), konf.String(CLIENT_PASSWORD)), nil
+	default:
+		return nil, fmt.Errorf("Unknown %s: %s", CLIENT_TYPE, clientType)
+	}
+}
+
+// Returns the number of bytes the client still has to download to the given path
+func PendingBytes(client TorrentClient, path string) (uint64, error) {
+	torrents, err := client.Torrents()
+	if err != nil {
+		return 0, err
+	}
+	var pending uint64
+	for _, t := range torrents {
+		if isSubPath(path, t.DownloadDir) {
+			pending += t.LeftUntilDone
+		}
+	}
+	return pending, nil
+}
+
+// Returns true if child is path or inside of it
+func isSubPath(path, child string) bool {
+	rel, err := filepath.Rel(filepath.Clean(path), filepath.Clean(child))
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, "../")
+}
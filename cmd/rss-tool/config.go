@@ -0,0 +1,548 @@
+package main
+
+/*
+ * RSS Download Tool
+ * Copyright (c) 2021 Aaron Turner  <aturner at synfin dot net>
+ *
+ * This program is free software: you can redistribute it
+ * and/or modify it under the terms of the GNU General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or with the authors permission any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/knadh/koanf"
+	"github.com/knadh/koanf/providers/env"
+	"github.com/knadh/koanf/providers/file"
+	syscall "golang.org/x/sys/unix"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	REDACTED      = "<redacted>"
+	ENV_PREFIX    = "RSSDL_"
+	ENV_DELIM     = "__"
+	SECRET_TAG    = "!secret"
+	SECRET_SUFFIX = "_file"
+	INCLUDE       = "Include"
+	TEMPLATES     = "Templates"
+	EXTENDS       = "Extends"
+)
+
+// valid top level config keys.  A nil value means any sub-keys are allowed
+var CONFIG_KEYS = map[string][]string{
+	"Feeds":            nil,
+	INCLUDE:            {},
+	TEMPLATES:          nil,
+	PUSHOVER:           append(koanfKeys(reflect.TypeOf(PushoverOptions{})), "AppToken", "MaxPerHour"),
+	"Client":           {"Type", "Url", "Username", "Password"},
+	"Retry":            {"Attempts", "Delay", "MaxDelay", "Timeout"},
+	"CircuitBreaker":   {"Failures", "Cooldown"},
+	USERS:              nil,
+	WEBHOOKS:           nil,
+	EMAIL:              koanfKeys(reflect.TypeOf(EmailConfig{})),
+	TARGETS:            nil,
+	PLACEMENT:          {},
+	DISK_PATH:          {},
+	DISK_BUFFER:        {},
+	DISK_USED:          {},
+	DISK_USED_TTL:      {},
+	RETENTION:          koanfKeys(reflect.TypeOf(RetentionPolicy{})),
+	CLEANUP_INTERVAL:   {},
+	INTERVAL:           {},
+	CACHE_LOCK_TIMEOUT: {},
+	ERROR_POLICY:       koanfKeys(reflect.TypeOf(ErrorPolicy{})),
+}
+
+// config keys which are always redacted by `config show`
+var SECRET_KEYS = []string{
+	PUSHOVER_APP_KEY,
+	PUSHOVER_USER_KEYS,
+}
+
+// any config key ending in one of these is considered a secret
+var SECRET_KEY_RE = regexp.MustCompile(`(?i)(token|password|passwd|secret|passkey|apikey)$`)
+
+// any URL query parameter with one of these names is considered a secret
+var SECRET_PARAM_RE = regexp.MustCompile(`(?i)^(passkey|apikey|api_key|key|token|auth|secret)$`)
+
+// Loads our config file and any included files and then applies any
+// environment variable overrides and secret file references
+func LoadConfig(path string) (*koanf.Koanf, error) {
+	konf := koanf.New(".")
+	if err := konf.Load(file.Provider(path), SecretYamlParser{}); err != nil {
+		return konf, err
+	}
+
+	includes, err := includeFiles(path, GetStrings(konf, INCLUDE))
+	if err != nil {
+		return konf, err
+	}
+	for _, include := range includes {
+		if err = konf.Load(file.Provider(include), SecretYamlParser{}); err != nil {
+			return konf, fmt.Errorf("Unable to load %s: %s", include, err)
+		}
+	}
+
+	// RSSDL_PUSHOVER__APPTOKEN => Pushover.AppToken
+	err = konf.Load(env.Provider(ENV_PREFIX, ".", func(s string) string {
+		return envToKey(konf, s)
+	}), nil)
+	if err != nil {
+		return konf, err
+	}
+
+	return konf, resolveSecrets(konf)
+}
+
+// Returns the list of files to include.  Relative paths are relative to
+// our config file and directories include all the *.yaml/*.yml files in them.
+func includeFiles(configFile string, includes []string) ([]string, error) {
+	files := []string{}
+	for _, include := range includes {
+		include = GetPath(include)
+		if !filepath.IsAbs(include) {
+			include = filepath.Join(filepath.Dir(configFile), include)
+		}
+		info, err := os.Stat(include)
+		if err != nil {
+			return files, fmt.Errorf("Unable to include %s: %s", include, err)
+		}
+		if !info.IsDir() {
+			files = append(files, include)
+			continue
+		}
+
+		dirFiles := []string{}
+		for _, glob := range []string{"*.yaml", "*.yml"} {
+			matches, _ := filepath.Glob(filepath.Join(include, glob))
+			dirFiles = append(dirFiles, matches...)
+		}
+		sort.Strings(dirFiles)
+		files = append(files, dirFiles...)
+	}
+	return files, nil
+}
+
+// Maps an environment variable name to the matching config key. Each
+// level of the key is separated by `__` and matched case-insensitively.
+func envToKey(konf *koanf.Koanf, envVar string) string {
+	parts := strings.Split(strings.TrimPrefix(envVar, ENV_PREFIX), ENV_DELIM)
+	path := ""
+	for i, part := range parts {
+		suffix := ""
+		if i == len(parts)-1 && strings.HasSuffix(strings.ToLower(part), SECRET_SUFFIX) {
+			part = part[:len(part)-len(SECRET_SUFFIX)]
+			suffix = SECRET_SUFFIX
+		}
+		known, _ := schemaKeys(konf, path)
+		known = append(known, konf.MapKeys(path)...)
+		for _, key := range known {
+			if strings.EqualFold(key, part) {
+				part = key
+				break
+			}
+		}
+		if path == "" {
+			path = part + suffix
+		} else {
+			path = fmt.Sprintf("%s.%s%s", path, part, suffix)
+		}
+	}
+	return path
+}
+
+// Replaces any `Key_file: <path>` and `Key: !secret <path>` values with
+// the contents of the given file
+func resolveSecrets(konf *koanf.Koanf) error {
+	for key, val := range konf.All() {
+		secretKey := ""
+		secretFile := ""
+		if strings.HasSuffix(strings.ToLower(key), SECRET_SUFFIX) {
+			secretKey = key[:len(key)-len(SECRET_SUFFIX)]
+			secretFile = fmt.Sprintf("%v", val)
+		} else if s, ok := val.(string); ok && strings.HasPrefix(s, SECRET_TAG+" ") {
+			secretKey = key
+			secretFile = strings.TrimSpace(strings.TrimPrefix(s, SECRET_TAG))
+		} else {
+			continue
+		}
+
+		secret, err := ioutil.ReadFile(GetPath(secretFile))
+		if err != nil {
+			return fmt.Errorf("Unable to read secret for %s: %s", secretKey, err)
+		}
+		konf.Delete(key)
+		if err = konf.Set(secretKey, strings.TrimSpace(string(secret))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Returns the value of the key as a list of strings.  Strings are split
+// on commas and newlines so values can come from env vars & secret files
+func GetStrings(konf *koanf.Koanf, key string) []string {
+	values := konf.Strings(key)
+	if s, ok := konf.Get(key).(string); ok {
+		values = []string{s}
+	}
+	return splitStrings(values)
+}
+
+// Splits each of the values on commas and newlines
+func splitStrings(values []string) []string {
+	ret := []string{}
+	for _, value := range values {
+		for _, v := range strings.FieldsFunc(value, func(r rune) bool { return r == ',' || r == '\n' }) {
+			if v = strings.TrimSpace(v); v != "" {
+				ret = append(ret, v)
+			}
+		}
+	}
+	return ret
+}
+
+// YAML parser which supports the `!secret <path>` tag
+type SecretYamlParser struct{}
+
+func (p SecretYamlParser) Unmarshal(b []byte) (map[string]interface{}, error) {
+	var node yaml.Node
+	if err := yaml.Unmarshal(b, &node); err != nil {
+		return nil, err
+	}
+	tagSecrets(&node)
+
+	out := map[string]interface{}{}
+	if err := node.Decode(&out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (p SecretYamlParser) Marshal(o map[string]interface{}) ([]byte, error) {
+	return yaml.Marshal(o)
+}
+
+// yaml.v3 discards unknown tags, so turn them into a string resolveSecrets() understands
+func tagSecrets(node *yaml.Node) {
+	if node.Kind == yaml.ScalarNode && node.Tag == SECRET_TAG {
+		node.Tag = "!!str"
+		node.Value = fmt.Sprintf("%s %s", SECRET_TAG, node.Value)
+	}
+	for _, child := range node.Content {
+		tagSecrets(child)
+	}
+}
+
+type ConfigCmd struct {
+	Validate ConfigValidateCmd `kong:"cmd,help='Validate the config file'"`
+	Show     ConfigShowCmd     `kong:"cmd,help='Print the effective config with secrets redacted'"`
+}
+
+type ConfigValidateCmd struct{}
+
+func (cmd *ConfigValidateCmd) Run(ctx *RunContext) error {
+	problems := ValidateConfig(ctx.Konf)
+	for _, p := range problems {
+		fmt.Printf("%s\n", p)
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("Config %s has %d problem(s)", GetPath(ctx.Cli.Config), len(problems))
+	}
+	fmt.Printf("Config %s is valid\n", GetPath(ctx.Cli.Config))
+	return nil
+}
+
+type ConfigShowCmd struct{}
+
+func (cmd *ConfigShowCmd) Run(ctx *RunContext) error {
+	PrintConfig(ctx.Konf)
+	return nil
+}
+
+// Returns a list of all the problems with the given config
+func ValidateConfig(konf *koanf.Koanf) []string {
+	problems := checkUnknownKeys(konf)
+
+	for _, key := range []string{INTERVAL, CLEANUP_INTERVAL, RETRY_DELAY, RETRY_MAX_DELAY, RETRY_TIMEOUT, BREAKER_COOLDOWN, CACHE_LOCK_TIMEOUT} {
+		if interval := konf.String(key); interval != "" {
+			if _, err := time.ParseDuration(interval); err != nil {
+				problems = append(problems, fmt.Sprintf("%s: %s", key, err))
+			}
+		}
+	}
+
+	problems = append(problems, validateTargets(konf)...)
+	problems = append(problems, validateUsers(konf)...)
+	problems = append(problems, validateWebhooks(konf)...)
+	problems = append(problems, validateEmail(konf)...)
+
+	if err := konf.Unmarshal(ERROR_POLICY, &ErrorPolicy{}); err != nil {
+		problems = append(problems, fmt.Sprintf("%s: %s", ERROR_POLICY, err))
+	}
+
+	if _, err := NewTorrentClient(konf); err != nil {
+		problems = append(problems, err.Error())
+	}
+
+	for _, feedName := range konf.MapKeys("Feeds") {
+		problems = append(problems, validateFeed(konf, feedName)...)
+	}
+	return problems
+}
+
+// Validate a single feed
+func validateFeed(konf *koanf.Koanf, feedName string) []string {
+	problems := []string{}
+	feed, err := LoadFeed(konf, feedName)
+	if err != nil {
+		return append(problems, fmt.Sprintf("Feeds.%s: %s", feedName, err))
+	}
+
+	if path := feed.GetDownloadPath(); path == "" {
+		if targetsNeedDownloadPath(konf) {
+			problems = append(problems, fmt.Sprintf("Feeds.%s.DownloadPath: missing", feedName))
+		}
+	} else if err := checkWritableDir(path); err != nil {
+		problems = append(problems, fmt.Sprintf("Feeds.%s.DownloadPath: %s", feedName, err))
+	}
+
+	if feedKonf, err := feedConfig(konf, "Feeds."+feedName); err == nil {
+		if tz := feedKonf.String("Timezone"); tz != "" {
+			if _, err := time.LoadLocation(tz); err != nil {
+				problems = append(problems, fmt.Sprintf("Feeds.%s.Timezone: %s", feedName, err))
+			}
+		}
+	}
+
+	sample := RssFeedEntry{FeedName: feedName, Title: "Show.Name.S01E01.1080p"}
+	if _, err := feed.DownloadFilename(os.TempDir(), sample); err != nil {
+		problems = append(problems, fmt.Sprintf("Feeds.%s: %s", feedName, err))
+	}
+
+	if _, err := PushoverFor(konf, feed, sample); err != nil {
+		problems = append(problems, fmt.Sprintf("Feeds.%s.%s: %s", feedName, PUSHOVER, err))
+	}
+
+	filters := feed.GetFilters()
+	names := make([]string, 0, len(filters))
+	for name := range filters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		filter := filters[name]
+		if err := filter.Compile(); err != nil {
+			problems = append(problems, fmt.Sprintf("Feeds.%s.Filters.%s: %s", feedName, name, err))
+		}
+		sample.Filter = name
+		if _, err := PushoverFor(konf, feed, sample); err != nil {
+			problems = append(problems, fmt.Sprintf("Feeds.%s.Filters.%s.%s: %s", feedName, name, PUSHOVER, err))
+		}
+	}
+	return problems
+}
+
+// Returns an error if the path is not a directory we can write to
+func checkWritableDir(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", path)
+	}
+	if err = syscall.Access(path, syscall.W_OK); err != nil {
+		return fmt.Errorf("%s is not writable: %s", path, err)
+	}
+	return nil
+}
+
+// Looks for any keys in the config which we do not understand
+func checkUnknownKeys(konf *koanf.Koanf) []string {
+	return unknownKeys(konf, "")
+}
+
+// Recursively returns a problem for each unknown key under path
+func unknownKeys(konf *koanf.Koanf, path string) []string {
+	problems := []string{}
+	validKeys, restricted := schemaKeys(konf, path)
+	for _, key := range konf.MapKeys(path) {
+		keyPath := key
+		if path != "" {
+			keyPath = fmt.Sprintf("%s.%s", path, key)
+		}
+		if restricted {
+			found := false
+			for _, valid := range validKeys {
+				if key == valid {
+					found = true
+					break
+				}
+			}
+			if !found {
+				problems = append(problems, fmt.Sprintf("%s: unknown key", keyPath))
+				continue
+			}
+		}
+		problems = append(problems, unknownKeys(konf, keyPath)...)
+	}
+	return problems
+}
+
+// Returns the valid config keys directly under path and true, or false if
+// we don't know what keys are valid
+func schemaKeys(konf *koanf.Koanf, path string) ([]string, bool) {
+	if path == "" {
+		keys := []string{}
+		for key := range CONFIG_KEYS {
+			keys = append(keys, key)
+		}
+		return keys, true
+	}
+
+	parts := strings.Split(path, ".")
+	switch {
+	case len(parts) == 1:
+		keys := CONFIG_KEYS[parts[0]]
+		return keys, keys != nil
+	case len(parts) == 2 && (parts[0] == "Feeds" || parts[0] == TEMPLATES):
+		feedKonf, err := feedConfig(konf, path)
+		if err != nil {
+			// reported by validateFeed()
+			return []string{}, false
+		}
+		newFeed, ok := RSS_FEED_TYPES[feedKonf.String("FeedType")]
+		if !ok {
+			// templates don't need a FeedType
+			return []string{EXTENDS}, false
+		}
+		return append(koanfKeys(reflect.TypeOf(newFeed())), EXTENDS), true
+	case len(parts) == 2 && parts[0] == WEBHOOKS:
+		return koanfKeys(reflect.TypeOf(Webhook{})), true
+	case len(parts) == 2 && parts[0] == USERS:
+		return koanfKeys(reflect.TypeOf(User{})), true
+	case len(parts) == 2 && parts[0] == TARGETS:
+		return append(koanfKeys(reflect.TypeOf(DownloadTarget{})), RETENTION), true
+	case len(parts) == 3 && parts[0] == TARGETS && parts[2] == RETENTION:
+		return koanfKeys(reflect.TypeOf(RetentionPolicy{})), true
+	case len(parts) == 3 && (parts[0] == "Feeds" || parts[0] == TEMPLATES) && parts[2] == PUSHOVER,
+		len(parts) == 5 && (parts[0] == "Feeds" || parts[0] == TEMPLATES) && parts[4] == PUSHOVER:
+		return koanfKeys(reflect.TypeOf(PushoverOptions{})), true
+	case len(parts) == 2 && parts[0] == PUSHOVER && parts[1] == DIGEST,
+		len(parts) == 4 && (parts[0] == "Feeds" || parts[0] == TEMPLATES) && parts[3] == DIGEST,
+		len(parts) == 6 && (parts[0] == "Feeds" || parts[0] == TEMPLATES) && parts[5] == DIGEST:
+		return koanfKeys(reflect.TypeOf(DigestPolicy{})), true
+	case len(parts) == 3 && (parts[0] == "Feeds" || parts[0] == TEMPLATES) && parts[2] == ERROR_POLICY:
+		return koanfKeys(reflect.TypeOf(ErrorPolicy{})), true
+	case len(parts) == 4 && (parts[0] == "Feeds" || parts[0] == TEMPLATES) && parts[2] == "Filters":
+		return koanfKeys(reflect.TypeOf(RssFilter{})), true
+	}
+	return []string{}, false
+}
+
+// Returns the list of config keys koanf will unmarshal into the given struct
+func koanfKeys(t reflect.Type) []string {
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	keys := []string{}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" {
+			continue // unexported
+		}
+		name := strings.Split(field.Tag.Get("koanf"), ",")[0]
+		if name == "-" {
+			continue
+		} else if name == "" {
+			name = field.Name
+		}
+		keys = append(keys, name)
+	}
+	return keys
+}
+
+// Print the effective config with any secrets redacted
+func PrintConfig(konf *koanf.Koanf) {
+	all := konf.All()
+	for _, key := range konf.Keys() {
+		fmt.Printf("%s -> %v\n", key, redactValue(key, all[key]))
+	}
+}
+
+// Returns the value to display for the given config key
+func redactValue(key string, val interface{}) interface{} {
+	for _, secret := range SECRET_KEYS {
+		if key == secret {
+			return REDACTED
+		}
+	}
+	parts := strings.Split(key, ".")
+	if SECRET_KEY_RE.MatchString(parts[len(parts)-1]) {
+		return REDACTED
+	}
+	// per feed/filter & per user pushover user keys
+	if strings.HasSuffix(key, "."+PUSHOVER_USER_KEYS) ||
+		(len(parts) == 3 && parts[0] == USERS && parts[2] == PUSHOVER) {
+		return REDACTED
+	}
+	// webhook credentials
+	if len(parts) == 4 && parts[0] == WEBHOOKS && parts[2] == "Headers" &&
+		strings.EqualFold(parts[3], "Authorization") {
+		return REDACTED
+	}
+
+	if s, ok := val.(string); ok {
+		return redactUrl(s)
+	}
+	return val
+}
+
+// Redacts any secret query parameters in the given URL
+func redactUrl(s string) string {
+	if !strings.Contains(s, "://") {
+		return s
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return s
+	}
+	changed := false
+	if _, hasPassword := u.User.Password(); hasPassword {
+		u.User = url.UserPassword(u.User.Username(), "xxxxx")
+		changed = true
+	}
+	q := u.Query()
+	for param := range q {
+		if SECRET_PARAM_RE.MatchString(param) {
+			q.Set(param, "xxxxx")
+			changed = true
+		}
+	}
+	if !changed {
+		return s
+	}
+	u.RawQuery = q.Encode()
+	return u.String()
+}
@@ -0,0 +1,151 @@
+package main
+
+/*
+ * RSS Download Tool
+ * Copyright (c) 2021 Aaron Turner  <aturner at synfin dot net>
+ *
+ * This program is free software: you can redistribute it
+ * and/or modify it under the terms of the GNU General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or with the authors permission any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/knadh/koanf"
+	"github.com/knadh/koanf/providers/confmap"
+)
+
+// Returns a koanf with the given flattened keys
+func testKonf(t *testing.T, values map[string]interface{}) *koanf.Koanf {
+	konf := koanf.New(".")
+	if err := konf.Load(confmap.Provider(values, "."), nil); err != nil {
+		t.Fatalf("Unable to load config: %s", err)
+	}
+	return konf
+}
+
+func TestEnvToKey(t *testing.T) {
+	konf := testKonf(t, map[string]interface{}{
+		"Feeds.MyFeed.FeedType": "RFM",
+		"Feeds.MyFeed.BaseUrl":  "http://example.com/rss",
+		"Users.alice.Pushover":  "key",
+	})
+	tests := []struct {
+		env string
+		key string
+	}{
+		{"RSSDL_PUSHOVER__APPTOKEN", "Pushover.AppToken"},
+		{"RSSDL_pushover__apptoken", "Pushover.AppToken"},
+		{"RSSDL_DISKPATH", "DiskPath"},
+		{"RSSDL_FEEDS__MYFEED__BASEURL", "Feeds.MyFeed.BaseUrl"},
+		{"RSSDL_FEEDS__MYFEED__AUTODOWNLOAD", "Feeds.MyFeed.AutoDownload"},
+		{"RSSDL_USERS__ALICE__EMAIL", "Users.alice.Email"},
+		// secret file references keep their suffix
+		{"RSSDL_PUSHOVER__APPTOKEN_FILE", "Pushover.AppToken_file"},
+		{"RSSDL_USERS__ALICE__PUSHOVER_file", "Users.alice.Pushover_file"},
+		// unknown keys are left as they are
+		{"RSSDL_NEWFEED", "NEWFEED"},
+		{"RSSDL_FEEDS__OTHER__BASEURL", "Feeds.OTHER.BASEURL"},
+	}
+
+	for _, test := range tests {
+		if key := envToKey(konf, test.env); key != test.key {
+			t.Errorf("envToKey(%s) = %s, expected %s", test.env, key, test.key)
+		}
+	}
+}
+
+func TestResolveSecrets(t *testing.T) {
+	dir := t.TempDir()
+	appToken := filepath.Join(dir, "apptoken")
+	userKey := filepath.Join(dir, "userkey")
+	if err := ioutil.WriteFile(appToken, []byte("  app-secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(userKey, []byte("user-secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	konf := testKonf(t, map[string]interface{}{
+		"Pushover.AppToken_file": appToken,
+		"Users.alice.Pushover":   SECRET_TAG + " " + userKey,
+		"Users.alice.Email":      "alice@example.com",
+	})
+	if err := resolveSecrets(konf); err != nil {
+		t.Fatalf("resolveSecrets returned error: %s", err)
+	}
+	expected := map[string]string{
+		"Pushover.AppToken":    "app-secret",
+		"Users.alice.Pushover": "user-secret",
+		"Users.alice.Email":    "alice@example.com",
+	}
+	for key, value := range expected {
+		if got := konf.String(key); got != value {
+			t.Errorf("%s = %q, expected %q", key, got, value)
+		}
+	}
+	if konf.Exists("Pushover.AppToken_file") {
+		t.Errorf("Pushover.AppToken_file wasn't removed")
+	}
+
+	missing := testKonf(t, map[string]interface{}{
+		"Pushover.AppToken_file": filepath.Join(dir, "missing"),
+	})
+	if err := resolveSecrets(missing); err == nil {
+		t.Errorf("Expected an error for a missing secret file")
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, data string) string {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	write("token", "tagged-secret")
+	config := write("config.yaml", `
+Pushover:
+  AppToken: !secret `+filepath.Join(dir, "token")+`
+  Users: from-file
+DiskPath: /from/file
+`)
+
+	t.Setenv("RSSDL_PUSHOVER__USERS", "from-env")
+	t.Setenv("RSSDL_DISKBUFFER", "10GB")
+	konf, err := LoadConfig(config)
+	if err != nil {
+		t.Fatalf("LoadConfig returned error: %s", err)
+	}
+	expected := map[string]string{
+		"Pushover.AppToken": "tagged-secret",
+		"Pushover.Users":    "from-env",
+		"DiskPath":          "/from/file",
+		"DiskBuffer":        "10GB",
+	}
+	for key, value := range expected {
+		if got := konf.String(key); got != value {
+			t.Errorf("%s = %q, expected %q", key, got, value)
+		}
+	}
+	for _, key := range konf.Keys() {
+		if strings.HasPrefix(strings.ToUpper(key), "RSSDL") {
+			t.Errorf("Unexpected key %s", key)
+		}
+	}
+}
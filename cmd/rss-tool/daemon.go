@@ -0,0 +1,382 @@
+package main
+
+/*
+ * RSS Download Tool
+ * Copyright (c) 2021 Aaron Turner  <aturner at synfin dot net>
+ *
+ * This program is free software: you can redistribute it
+ * and/or modify it under the terms of the GNU General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or with the authors permission any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/knadh/koanf"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	INTERVAL        = "Interval"
+	RELOAD_DEBOUNCE = 500 * time.Millisecond
+)
+
+type DaemonCmd struct {
+	Cache    string        `kong:"optional,name='cache',short='c',default='${CACHE_FILE}',help='Cache file'"`
+	Interval time.Duration `kong:"optional,name='interval',default='15m',help='Default time between checking each feed'"`
+	DryRun   bool          `kong:"help='Do not notify or update cache'"`
+}
+
+// When the given feed is next due to be checked
+type feedSchedule struct {
+	Interval time.Duration
+	LastRun  time.Time
+	NextRun  time.Time
+}
+
+type Daemon struct {
+	cmd        *DaemonCmd
+	ctx        *RunContext
+	configFile string
+	konf       *koanf.Koanf
+	konfLock   sync.RWMutex
+	schedules  map[string]*feedSchedule
+	reload     chan *koanf.Koanf
+	watching   map[string]bool
+	cleanup    feedSchedule // zero Interval disables cleanup
+	queuedDue  time.Time    // zero when no digest, held notification or report is waiting
+}
+
+func (cmd *DaemonCmd) Run(ctx *RunContext) error {
+	d := Daemon{
+		cmd:        cmd,
+		ctx:        ctx,
+		configFile: GetPath(ctx.Cli.Config),
+		konf:       ctx.Konf,
+		schedules:  map[string]*feedSchedule{},
+		reload:     make(chan *koanf.Koanf),
+		watching:   map[string]bool{},
+	}
+
+	if problems := ValidateConfig(d.konf); len(problems) > 0 {
+		return fmt.Errorf("Invalid config: %s", strings.Join(problems, ", "))
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+	d.watchConfig(watcher)
+	go d.handleEvents(watcher)
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+
+	d.reschedule()
+	for {
+		timer := time.NewTimer(time.Until(d.nextRun()))
+		select {
+		case konf := <-d.reload:
+			timer.Stop()
+			d.konfLock.Lock()
+			d.konf = konf
+			d.konfLock.Unlock()
+			d.watchConfig(watcher)
+			d.reschedule()
+
+		case sig := <-signals:
+			timer.Stop()
+			if sig == syscall.SIGHUP {
+				go d.reloadConfig()
+				continue
+			}
+			log.Infof("Exiting on %s", sig)
+			return nil
+
+		case <-timer.C:
+			d.runFeeds()
+			d.runCleanup()
+		}
+	}
+}
+
+// Returns the current config
+func (d *Daemon) config() *koanf.Koanf {
+	d.konfLock.RLock()
+	defer d.konfLock.RUnlock()
+	return d.konf
+}
+
+// Returns a RunContext for running the given feed with the current config
+func (d *Daemon) runContext() *RunContext {
+	cli := *d.ctx.Cli
+	cli.Push = PushCmd{
+		Cache:  d.cmd.Cache,
+		DryRun: d.cmd.DryRun,
+	}
+	return &RunContext{
+		Ctx:  d.ctx.Ctx,
+		Cli:  &cli,
+		Konf: d.config(),
+	}
+}
+
+// Processes all the feeds which are due in Order
+func (d *Daemon) runFeeds() {
+	feeds, _ := SortedFeeds(d.config(), "")
+	now := time.Now()
+	due := []string{}
+	for _, feed := range feeds {
+		schedule, ok := d.schedules[feed]
+		if !ok || schedule.NextRun.After(now) {
+			continue
+		}
+		due = append(due, feed)
+		schedule.LastRun = now
+		schedule.NextRun = now.Add(schedule.Interval)
+	}
+
+	// with no feeds due, we may still have queued notifications to send
+	if len(due) > 0 || (!d.queuedDue.IsZero() && !d.queuedDue.After(now)) {
+		d.pushFeeds(due)
+	}
+
+	if d.ctx.Cli.Metrics != "" {
+		if err := METRICS.Write(GetPath(d.ctx.Cli.Metrics)); err != nil {
+			log.WithError(err).Errorf("Unable to write metrics: %s", d.ctx.Cli.Metrics)
+		}
+	}
+}
+
+// Processes the given feeds with a single cache read & write
+func (d *Daemon) pushFeeds(feeds []string) {
+	ctx := d.runContext()
+	cache, err := OpenCache(d.cmd.Cache, CacheLockTimeout(ctx.Konf))
+	if err != nil {
+		log.WithError(err).Errorf("Unable to open cache: %s", d.cmd.Cache)
+		return
+	}
+	// deferred first, so the webhooks are sent after the cache is unlocked
+	defer SendPublished(ctx.Konf, cache)
+	defer cache.Close()
+	if len(feeds) > 0 {
+		space := NewSpaceTracker(ctx.Konf)
+		err = processFeeds(ctx.Konf, cache, d.cmd.DryRun, feeds, func(feedName string) error {
+			return push(ctx, cache, feedName, space)
+		})
+		if err != nil {
+			log.Error(err.Error())
+		}
+	}
+	if d.cmd.DryRun {
+		return
+	}
+	if err = FlushQueued(ctx.Konf, cache); err != nil {
+		log.WithError(err).Errorf("Unable to send queued notifications")
+	}
+	d.queuedDue = cache.NextQueued()
+	if report := NextReport(ctx.Konf, cache); !report.IsZero() && (d.queuedDue.IsZero() || report.Before(d.queuedDue)) {
+		d.queuedDue = report
+	}
+	if now := time.Now(); !d.queuedDue.IsZero() && !d.queuedDue.After(now) {
+		// something failed to send, don't try again straight away
+		d.queuedDue = now.Add(QUEUED_RETRY_DELAY)
+	}
+	if err = cache.SaveCache(); err != nil {
+		log.WithError(err).Errorf("Unable to save cache: %s", d.cmd.Cache)
+	}
+}
+
+// Returns when the next feed is due
+func (d *Daemon) nextRun() time.Time {
+	next := time.Now().Add(d.cmd.Interval)
+	for _, schedule := range d.schedules {
+		if schedule.NextRun.Before(next) {
+			next = schedule.NextRun
+		}
+	}
+	if d.cleanup.Interval > 0 && d.cleanup.NextRun.Before(next) {
+		next = d.cleanup.NextRun
+	}
+	if !d.queuedDue.IsZero() && d.queuedDue.Before(next) {
+		next = d.queuedDue
+	}
+	return next
+}
+
+// Returns how often the given feed should be checked
+func (d *Daemon) feedInterval(feedName string) time.Duration {
+	feed, err := LoadFeed(d.config(), feedName)
+	if err == nil && feed.GetInterval() > 0 {
+		return feed.GetInterval()
+	}
+	if interval := d.config().Duration(INTERVAL); interval > 0 {
+		return interval
+	}
+	return d.cmd.Interval
+}
+
+// Updates our feed schedules to match the current config
+func (d *Daemon) reschedule() {
+	feeds, _ := SortedFeeds(d.config(), "")
+	now := time.Now()
+	current := map[string]bool{}
+	for _, feed := range feeds {
+		current[feed] = true
+		interval := d.feedInterval(feed)
+		schedule, ok := d.schedules[feed]
+		if !ok {
+			log.Infof("Scheduling %s every %s", feed, interval)
+			d.schedules[feed] = &feedSchedule{
+				Interval: interval,
+				NextRun:  now,
+			}
+		} else if schedule.Interval != interval {
+			log.Infof("Rescheduling %s every %s", feed, interval)
+			schedule.Interval = interval
+			schedule.NextRun = schedule.LastRun.Add(interval)
+		}
+	}
+
+	for feed := range d.schedules {
+		if !current[feed] {
+			log.Infof("Removing schedule for %s", feed)
+			delete(d.schedules, feed)
+		}
+	}
+
+	interval := d.config().Duration(CLEANUP_INTERVAL)
+	if interval != d.cleanup.Interval {
+		if interval > 0 {
+			log.Infof("Scheduling cleanup every %s", interval)
+		} else {
+			log.Infof("Removing cleanup schedule")
+		}
+		d.cleanup.Interval = interval
+		d.cleanup.NextRun = d.cleanup.LastRun.Add(interval)
+	}
+}
+
+// Applies the Retention policies if they are due
+func (d *Daemon) runCleanup() {
+	now := time.Now()
+	if d.cleanup.Interval <= 0 || d.cleanup.NextRun.After(now) {
+		return
+	}
+	if _, err := Cleanup(d.config(), "", d.cmd.DryRun); err != nil {
+		log.WithError(err).Errorf("Unable to clean up")
+	}
+	d.cleanup.LastRun = now
+	d.cleanup.NextRun = now.Add(d.cleanup.Interval)
+}
+
+// Returns the config file and any included files and directories
+func (d *Daemon) configPaths() []string {
+	paths := []string{d.configFile}
+	for _, include := range GetStrings(d.config(), INCLUDE) {
+		include = GetPath(include)
+		if !filepath.IsAbs(include) {
+			include = filepath.Join(filepath.Dir(d.configFile), include)
+		}
+		paths = append(paths, filepath.Clean(include))
+	}
+	return paths
+}
+
+// Watches the directories holding our config files.  Directories are
+// watched instead of files so we notice editors replacing the file.
+func (d *Daemon) watchConfig(watcher *fsnotify.Watcher) {
+	for _, path := range d.configPaths() {
+		dirs := []string{filepath.Dir(path)}
+		if info, err := os.Stat(path); err == nil && info.IsDir() {
+			dirs = append(dirs, path)
+		}
+		for _, dir := range dirs {
+			if d.watching[dir] {
+				continue
+			}
+			if err := watcher.Add(dir); err != nil {
+				log.WithError(err).Errorf("Unable to watch %s", dir)
+				continue
+			}
+			d.watching[dir] = true
+		}
+	}
+}
+
+// Returns true if the given file is part of our config
+func (d *Daemon) isConfigFile(name string) bool {
+	name = filepath.Clean(name)
+	for _, path := range d.configPaths() {
+		if name == path || filepath.Dir(name) == path {
+			return true
+		}
+	}
+	return false
+}
+
+// Triggers a config reload when any of our config files change
+func (d *Daemon) handleEvents(watcher *fsnotify.Watcher) {
+	var debounce <-chan time.Time
+	for {
+		select {
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			if d.isConfigFile(event.Name) {
+				log.Debugf("Config change: %s", event)
+				debounce = time.After(RELOAD_DEBOUNCE)
+			}
+
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			log.WithError(err).Errorf("Config watch error")
+
+		case <-debounce:
+			debounce = nil
+			d.reloadConfig()
+		}
+	}
+}
+
+// Loads and validates the config.  Only a valid config is handed to the
+// main loop, otherwise we keep using the old config.
+func (d *Daemon) reloadConfig() {
+	log.Infof("Reloading config: %s", d.configFile)
+	konf, err := LoadConfig(d.configFile)
+	if err == nil {
+		if problems := ValidateConfig(konf); len(problems) > 0 {
+			err = fmt.Errorf("%s", strings.Join(problems, "\n"))
+		}
+	}
+	if err != nil {
+		err = fmt.Errorf("Invalid config %s, keeping previous config:\n%s", d.configFile, err)
+		log.Error(err.Error())
+		if err = SendPushError(d.config(), err); err != nil {
+			log.WithError(err).Errorf("Unable to send error notification")
+		}
+		return
+	}
+	d.reload <- konf
+}
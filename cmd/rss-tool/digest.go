@@ -0,0 +1,279 @@
+package main
+
+/*
+ * RSS Download Tool
+ * Copyright (c) 2021 Aaron Turner  <aturner at synfin dot net>
+ *
+ * This program is free software: you can redistribute it
+ * and/or modify it under the terms of the GNU General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or with the authors permission any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+import (
+	"fmt"
+	"html"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gregdel/pushover"
+	"github.com/knadh/koanf"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	DIGEST             = "Digest"
+	QUEUED_RETRY_DELAY = 5 * time.Minute // after failing to send queued notifications
+)
+
+// When to send a summary of the queued matches instead of a message per match
+type DigestPolicy struct {
+	Interval time.Duration `koanf:"Interval"` // every Interval, aligned to midnight UTC
+	Times    []string      `koanf:"Times"`    // or at these times of day, HH:MM
+	Timezone string        `koanf:"Timezone"` // for Times, default is local time
+}
+
+// A match waiting to be sent in a digest
+type DigestEntry struct {
+	Entry RssFeedEntry `json:"Entry"`
+	Due   time.Time    `json:"Due"`
+}
+
+// Returns if matches are batched into a digest
+func (dp *DigestPolicy) Enabled() bool {
+	return dp != nil && (dp.Interval > 0 || len(splitStrings(dp.Times)) > 0)
+}
+
+// Returns when the digest holding a match queued at now should be sent
+func (dp *DigestPolicy) NextSend(now time.Time) (time.Time, error) {
+	next := time.Time{}
+	if dp.Interval > 0 {
+		next = now.Truncate(dp.Interval).Add(dp.Interval)
+	}
+
+	loc, err := time.LoadLocation(dp.Timezone)
+	if err != nil {
+		return next, err
+	}
+	local := now.In(loc)
+	for _, clock := range splitStrings(dp.Times) {
+		minute, err := parseClock(clock)
+		if err != nil {
+			return next, err
+		}
+		// not midnight + minutes, which is off by an hour on DST changes
+		t := time.Date(local.Year(), local.Month(), local.Day(), minute/60, minute%60, 0, 0, loc)
+		if !t.After(now) {
+			t = time.Date(local.Year(), local.Month(), local.Day()+1, minute/60, minute%60, 0, 0, loc)
+		}
+		if next.IsZero() || t.Before(next) {
+			next = t
+		}
+	}
+	return next, nil
+}
+
+// Emails the entry and sends a Pushover notification now or queues it for
+// the next digest.  Pushover is only optional when Email is configured.
+// A failure to email is logged and doesn't stop the Pushover notification.
+func NotifyEntry(konf *koanf.Koanf, cache *CacheFile, entry RssFeedEntry, feed RssFeed) ([]string, error) {
+	notified, emailErr := SendEmail(konf, entry, feed)
+	if _, email, _ := LoadEmail(konf); email && konf.String(PUSHOVER_APP_KEY) == "" {
+		// email is the only way to notify, so it has to work
+		return notified, emailErr
+	}
+	if emailErr != nil {
+		log.Error(emailErr.Error())
+	}
+
+	opts, err := PushoverFor(konf, feed, entry)
+	if err != nil {
+		return notified, err
+	}
+	if !opts.UseDigest() {
+		pushed, err := SendPush(konf, cache, entry, feed)
+		return mergeNames(notified, pushed), err
+	}
+	due, err := opts.Digest.NextSend(time.Now())
+	if err != nil {
+		return []string{}, err
+	}
+	log.Infof("Queued %s for the digest at %s", entry.Title, due.Format(time.RFC3339))
+	cache.Digest = append(cache.Digest, DigestEntry{Entry: entry, Due: due})
+	return notified, nil
+}
+
+// Returns the names in a followed by any in b which are not in a
+func mergeNames(a, b []string) []string {
+	ret := append([]string{}, a...)
+	for _, name := range b {
+		found := false
+		for _, r := range ret {
+			if r == name {
+				found = true
+				break
+			}
+		}
+		if !found {
+			ret = append(ret, name)
+		}
+	}
+	return ret
+}
+
+// Returns when the next digest is due, or the zero time if nothing is queued
+func (c *CacheFile) NextDigest() time.Time {
+	next := time.Time{}
+	for _, d := range c.Digest {
+		if next.IsZero() || d.Due.Before(next) {
+			next = d.Due
+		}
+	}
+	return next
+}
+
+// Sends any digests, held notifications and reports which are due.  An
+// error from one doesn't stop the others from being sent.
+func FlushQueued(konf *koanf.Koanf, cache *CacheFile) error {
+	errs := []string{}
+	if err := FlushDigest(konf, cache); err != nil {
+		errs = append(errs, fmt.Sprintf("digest: %s", err))
+	}
+	if err := FlushHeld(konf, cache); err != nil {
+		errs = append(errs, fmt.Sprintf("held notifications: %s", err))
+	}
+	if err := sendReportIfDue(konf, cache); err != nil {
+		errs = append(errs, fmt.Sprintf("report: %s", err))
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// Returns when the next digest or held notification is due, or the zero
+// time if nothing is waiting
+func (c *CacheFile) NextQueued() time.Time {
+	next := c.NextDigest()
+	if held := c.NextHeld(); !held.IsZero() && (next.IsZero() || held.Before(next)) {
+		next = held
+	}
+	return next
+}
+
+// Sends a summary of all the queued matches which are due to each recipient
+func FlushDigest(konf *koanf.Koanf, cache *CacheFile) error {
+	now := time.Now()
+	due := []RssFeedEntry{}
+	for _, d := range cache.Digest {
+		if !d.Due.After(now) {
+			due = append(due, d.Entry)
+		}
+	}
+	if len(due) == 0 {
+		return nil
+	}
+
+	appKey := konf.String(PUSHOVER_APP_KEY)
+	if appKey == "" {
+		return fmt.Errorf("Missing `%s` in config", PUSHOVER_APP_KEY)
+	}
+	opts, err := LoadPushover(konf)
+	if err != nil {
+		return err
+	}
+	priority, _ := opts.GetPriority()
+
+	// collect the entries for each recipient
+	recipients := []pushRecipient{}
+	entries := map[string][]RssFeedEntry{}
+	for _, entry := range due {
+		entryOpts := opts
+		if feed, err := LoadFeed(konf, entry.FeedName); err == nil {
+			entryOpts, _ = PushoverFor(konf, feed, entry)
+		}
+		users, err := pushRecipients(konf, entry, entryOpts)
+		if err != nil {
+			return err
+		}
+		for _, r := range users {
+			if _, ok := entries[r.Key]; !ok {
+				recipients = append(recipients, r)
+			}
+			entries[r.Key] = append(entries[r.Key], entry)
+		}
+	}
+
+	app := pushover.New(appKey)
+	notified := map[string][]string{}
+	for _, r := range recipients {
+		titles := []string{}
+		for _, entry := range entries[r.Key] {
+			titles = append(titles, entry.Title)
+		}
+		message := &pushover.Message{
+			HTML:      true,
+			Message:   digestMessage(konf, entries[r.Key]),
+			Title:     fmt.Sprintf("%d new torrent(s)", len(entries[r.Key])),
+			Priority:  priority,
+			Timestamp: now.Unix(),
+			Retry:     opts.Retry,
+			Expire:    opts.Expire,
+			TTL:       opts.TTL,
+			Sound:     opts.Sound,
+		}
+		if r.send(cache, app, message, titles) && r.Name != "" {
+			for _, title := range titles {
+				notified[title] = append(notified[title], r.Name)
+			}
+		}
+	}
+
+	// record who was notified & remove the due entries from the queue.
+	// send() held the digest for anyone it couldn't be sent to.
+	for i, entry := range cache.Entries {
+		if names, ok := notified[entry.Title]; ok {
+			cache.Entries[i].Notified = append(cache.Entries[i].Notified, names...)
+		}
+	}
+	queued := []DigestEntry{}
+	for _, d := range cache.Digest {
+		if d.Due.After(now) {
+			queued = append(queued, d)
+		}
+	}
+	cache.Digest = queued
+	log.Infof("Sent digest of %d match(es) to %d recipient(s)", len(due), len(recipients))
+	return nil
+}
+
+// Returns the HTML summary of the entries, trimmed to fit in a message
+func digestMessage(konf *koanf.Koanf, entries []RssFeedEntry) string {
+	msgText := ""
+	for i, entry := range entries {
+		url := entry.Url
+		if feed, err := LoadFeed(konf, entry.FeedName); err == nil {
+			url = feed.UrlRewriter(entry.Url)
+		}
+		line := fmt.Sprintf("<a href=\"%s\">%s</a> [%s] %s\n",
+			html.EscapeString(url), html.EscapeString(entry.Title), entry.FeedName, entry.TorrentSize)
+		more := ""
+		if i < len(entries)-1 {
+			more = fmt.Sprintf("... and %d more", len(entries)-i)
+		}
+		if utf8.RuneCountInString(msgText+line+more) > pushover.MessageMaxLength {
+			return msgText + fmt.Sprintf("... and %d more", len(entries)-i)
+		}
+		msgText += line
+	}
+	return msgText
+}
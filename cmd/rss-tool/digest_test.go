@@ -0,0 +1,112 @@
+package main
+
+/*
+ * RSS Download Tool
+ * Copyright (c) 2021 Aaron Turner  <aturner at synfin dot net>
+ *
+ * This program is free software: you can redistribute it
+ * and/or modify it under the terms of the GNU General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or with the authors permission any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDigestPolicyNextSend(t *testing.T) {
+	ny, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skipf("No timezone data: %s", err)
+	}
+	utc := func(month time.Month, day, hour, min int) time.Time {
+		return time.Date(2023, month, day, hour, min, 0, 0, time.UTC)
+	}
+
+	tests := []struct {
+		name   string
+		policy DigestPolicy
+		now    time.Time
+		next   time.Time
+		err    bool
+	}{
+		{"Interval", DigestPolicy{Interval: 6 * time.Hour},
+			utc(4, 2, 8, 30), utc(4, 2, 12, 0), false},
+		{"Interval on the boundary", DigestPolicy{Interval: 6 * time.Hour},
+			utc(4, 2, 12, 0), utc(4, 2, 18, 0), false},
+		{"Interval past midnight", DigestPolicy{Interval: 6 * time.Hour},
+			utc(4, 2, 23, 0), utc(4, 3, 0, 0), false},
+		{"Times", DigestPolicy{Times: []string{"08:00, 20:00"}, Timezone: "UTC"},
+			utc(4, 2, 8, 30), utc(4, 2, 20, 0), false},
+		{"Times at the time", DigestPolicy{Times: []string{"08:00", "20:00"}, Timezone: "UTC"},
+			utc(4, 2, 8, 0), utc(4, 2, 20, 0), false},
+		{"Times tomorrow", DigestPolicy{Times: []string{"20:00", "08:00"}, Timezone: "UTC"},
+			utc(4, 2, 21, 0), utc(4, 3, 8, 0), false},
+		{"Times end of month", DigestPolicy{Times: []string{"08:00"}, Timezone: "UTC"},
+			utc(4, 30, 9, 0), utc(5, 1, 8, 0), false},
+		{"Interval before Times", DigestPolicy{Interval: time.Hour, Times: []string{"20:00"}, Timezone: "UTC"},
+			utc(4, 2, 8, 30), utc(4, 2, 9, 0), false},
+		{"Times before Interval", DigestPolicy{Interval: 24 * time.Hour, Times: []string{"20:00"}, Timezone: "UTC"},
+			utc(4, 2, 8, 30), utc(4, 2, 20, 0), false},
+		{"Timezone", DigestPolicy{Times: []string{"09:00"}, Timezone: "America/New_York"},
+			utc(4, 2, 12, 0), time.Date(2023, 4, 2, 9, 0, 0, 0, ny), false},
+		{"Timezone tomorrow", DigestPolicy{Times: []string{"09:00"}, Timezone: "America/New_York"},
+			utc(4, 2, 14, 0), time.Date(2023, 4, 3, 9, 0, 0, 0, ny), false},
+		// clocks went forward at 02:00 that morning
+		{"DST start", DigestPolicy{Times: []string{"03:00"}, Timezone: "America/New_York"},
+			time.Date(2023, 3, 12, 1, 0, 0, 0, ny), time.Date(2023, 3, 12, 3, 0, 0, 0, ny), false},
+		// and back at 02:00 that morning
+		{"DST end", DigestPolicy{Times: []string{"09:00"}, Timezone: "America/New_York"},
+			time.Date(2023, 11, 5, 0, 30, 0, 0, ny), time.Date(2023, 11, 5, 9, 0, 0, 0, ny), false},
+		{"invalid Times", DigestPolicy{Times: []string{"8am"}},
+			utc(4, 2, 8, 0), time.Time{}, true},
+		{"invalid Timezone", DigestPolicy{Times: []string{"08:00"}, Timezone: "Mars/Olympus"},
+			utc(4, 2, 8, 0), time.Time{}, true},
+	}
+
+	for _, test := range tests {
+		next, err := test.policy.NextSend(test.now)
+		if test.err {
+			if err == nil {
+				t.Errorf("%s: NextSend() = %s, expected an error", test.name, next)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: NextSend() returned error: %s", test.name, err)
+		} else if !next.Equal(test.next) {
+			t.Errorf("%s: NextSend(%s) = %s, expected %s", test.name, test.now, next, test.next)
+		}
+	}
+}
+
+func TestMergeNames(t *testing.T) {
+	tests := []struct {
+		a, b   []string
+		merged []string
+	}{
+		{[]string{}, []string{}, []string{}},
+		{[]string{"alice"}, []string{}, []string{"alice"}},
+		{[]string{}, []string{"bob", "alice"}, []string{"bob", "alice"}},
+		{[]string{"alice", "bob"}, []string{"bob", "carol"}, []string{"alice", "bob", "carol"}},
+		// names aren't split on commas
+		{[]string{"alice,bob"}, []string{"bob", "alice,bob"}, []string{"alice,bob", "bob"}},
+	}
+
+	for _, test := range tests {
+		merged := mergeNames(test.a, test.b)
+		if strings.Join(merged, "|") != strings.Join(test.merged, "|") {
+			t.Errorf("mergeNames(%v, %v) = %v, expected %v", test.a, test.b, merged, test.merged)
+		}
+	}
+}
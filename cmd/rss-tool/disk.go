@@ -3,10 +3,11 @@ package main
 // https://gist.github.com/ttys3/21e2a1215cf1905ab19ddcec03927c75
 
 import (
+	"errors"
 	"fmt"
 	"os"
-	"strconv"
-	"strings"
+	"sync"
+	"time"
 
 	"github.com/knadh/koanf"
 	log "github.com/sirupsen/logrus"
@@ -14,14 +15,16 @@ import (
 )
 
 const (
-	B           = 1
-	KB          = 1024 * B
-	MB          = 1024 * KB
-	GB          = 1024 * MB
-	TB          = 1024 * GB
-	DISK_BUFFER = "DiskBuffer"
+	DISK_BUFFER           = "DiskBuffer"
+	DISK_USED             = "DiskUsed"
+	DISK_USED_TTL         = "DiskUsedTTL"
+	DISK_USED_MODES       = "walk,statfs,none"
+	DEFAULT_DISK_USED     = "walk"
+	DEFAULT_DISK_USED_TTL = 5 * time.Minute
 )
 
+var ErrNoSpace = errors.New("Not enough free space")
+
 type DiskStatus struct {
 	All   uint64 `json:"all"`
 	Used  uint64 `json:"used"`
@@ -29,9 +32,14 @@ type DiskStatus struct {
 	Avail uint64 `json:"avail"`
 }
 
-// disk usage of path/disk
-func DiskUsage(konf *koanf.Koanf, path string) (DiskStatus, error) {
-	diskBuffer, err := convertBytesString(konf.String(DISK_BUFFER))
+// disk usage of path/disk leaving buffer bytes free.  used selects how
+// DiskStatus.Used is calculated:
+//
+//	walk:   size of all the files under path, cached for ttl
+//	statfs: space used on the whole filesystem
+//	none:   not calculated
+func DiskUsage(path, buffer, used string, ttl time.Duration) (DiskStatus, error) {
+	diskBuffer, err := ParseBytes(buffer)
 	if err != nil {
 		log.WithError(err).Errorf("Unable to apply %s", DISK_BUFFER)
 		diskBuffer = 0
@@ -56,15 +64,52 @@ func DiskUsage(konf *koanf.Koanf, path string) (DiskStatus, error) {
 
 	disk.Free = fs.Bfree * uint64(fs.Bsize)
 
+	switch used {
+	case "none":
+	case "statfs":
+		disk.Used = disk.All - disk.Free
+	case "walk", "":
+		disk.Used, err = cachedDirectorySize(path, ttl)
+		if err != nil {
+			return DiskStatus{}, err
+		}
+	default:
+		return DiskStatus{}, fmt.Errorf("Invalid %s: %s", DISK_USED, used)
+	}
+	return disk, nil
+}
+
+// directory sizes calculated by GetDirectorySize
+type dirSize struct {
+	Size uint64
+	At   time.Time
+}
+
+var dirSizeCache = map[string]dirSize{}
+var dirSizeLock sync.Mutex
+
+// Returns the size of the directory, only walking it if our cached
+// size is older than ttl
+func cachedDirectorySize(path string, ttl time.Duration) (uint64, error) {
+	dirSizeLock.Lock()
+	defer dirSizeLock.Unlock()
+
+	if cached, ok := dirSizeCache[path]; ok && time.Since(cached.At) < ttl {
+		return cached.Size, nil
+	}
+
+	start := time.Now()
 	info, err := os.Lstat(path)
 	if err != nil {
-		return DiskStatus{}, fmt.Errorf("Unable to Lstat %s: %s", path, err.Error())
+		return 0, fmt.Errorf("Unable to Lstat %s: %s", path, err.Error())
 	}
-	disk.Used, err = GetDirectorySize(path, info)
+	size, err := GetDirectorySize(path, info)
 	if err != nil {
-		return DiskStatus{}, fmt.Errorf("Unable to get directory size %s: %s", path, err.Error())
+		return 0, fmt.Errorf("Unable to get directory size %s: %s", path, err.Error())
 	}
-	return disk, nil
+	log.Debugf("Directory size of %s is %s, took %s", path, FormatBytes(size), time.Since(start))
+	dirSizeCache[path] = dirSize{Size: size, At: start}
+	return size, nil
 }
 
 func GetDirectorySize(path string, info os.FileInfo) (uint64, error) {
@@ -105,39 +150,65 @@ func (disk *DiskStatus) DiskInfo(newFileSize uint64) string {
 	if disk.Avail > (newFileSize + uint64(5*MB)) {
 		color = "#00ff00" // green
 	}
-	return fmt.Sprintf(`<font color="%s">%.2fGB Free, %.2fGB Used</font>`,
-		color,
-		float64(disk.Avail)/float64(GB),
-		float64(disk.Used)/float64(GB))
+	return fmt.Sprintf(`<font color="%s">%s Free, %s Used</font>`,
+		color, FormatBytes(disk.Avail), FormatBytes(disk.Used))
+}
+
+// Tracks disk space committed to downloads which are not on disk yet:
+// those accepted during this run and any the torrent client is still
+// downloading
+type SpaceTracker struct {
+	client    TorrentClient
+	committed map[string]uint64 // disk path => bytes accepted this run
+	pending   map[string]uint64 // disk path => bytes the client has yet to download
 }
 
-// Converts XXGB/TB/MB/KB to number of bytes
-func convertBytesString(str string) (uint64, error) {
-	if str == "" {
-		return 0, nil
-	}
-	var zBytes uint64
-	var err error
-
-	if strings.HasSuffix(str, "TB") {
-		tb := strings.Trim(str, "TB")
-		zBytes, err = strconv.ParseUint(tb, 10, 64)
-		zBytes *= TB
-	} else if strings.HasSuffix(str, "GB") {
-		gb := strings.Trim(str, "GB")
-		zBytes, err = strconv.ParseUint(gb, 10, 64)
-		zBytes *= GB
-	} else if strings.HasSuffix(str, "MB") {
-		mb := strings.Trim(str, "MB")
-		zBytes, err = strconv.ParseUint(mb, 10, 64)
-		zBytes *= MB
-	} else if strings.HasSuffix(str, "KB") {
-		kb := strings.Trim(str, "KB")
-		zBytes, err = strconv.ParseUint(kb, 10, 64)
-		zBytes *= KB
-	} else if strings.HasSuffix(str, "B") {
-		return 0, fmt.Errorf("Unparsable bytes string: %s", str)
-	}
-
-	return zBytes, err
+func NewSpaceTracker(konf *koanf.Koanf) *SpaceTracker {
+	client, err := NewTorrentClient(konf)
+	if err != nil {
+		log.WithError(err).Errorf("Unable to use torrent client")
+	}
+	return &SpaceTracker{
+		client:    client,
+		committed: map[string]uint64{},
+		pending:   map[string]uint64{},
+	}
+}
+
+// Returns the number of bytes already committed on the given disk path
+func (s *SpaceTracker) Committed(path string) uint64 {
+	if _, ok := s.pending[path]; !ok && s.client != nil {
+		pending, err := PendingBytes(s.client, path)
+		if err != nil {
+			log.WithError(err).Warnf("Unable to get in progress torrents")
+		}
+		log.Debugf("Torrent client has %s left to download to %s", FormatBytes(pending), path)
+		s.pending[path] = pending
+	}
+	return s.committed[path] + s.pending[path]
+}
+
+// Reserves space for the entry on the given disk or returns ErrNoSpace
+func (s *SpaceTracker) Reserve(path string, disk DiskStatus, entry RssFeedEntry) error {
+	if path == "" {
+		// no DiskPath, so nothing to check
+		return nil
+	}
+	committed := s.Committed(path)
+	if disk.Avail < committed || disk.Avail-committed < entry.TorrentBytes {
+		return fmt.Errorf("%w to download %s: need %s, have %s with %s committed",
+			ErrNoSpace, entry.Title, FormatBytes(entry.TorrentBytes),
+			FormatBytes(disk.Avail), FormatBytes(committed))
+	}
+	s.committed[path] += entry.TorrentBytes
+	return nil
+}
+
+// Releases the space reserved for an entry we failed to download
+func (s *SpaceTracker) Release(path string, entry RssFeedEntry) {
+	if s.committed[path] < entry.TorrentBytes {
+		s.committed[path] = 0
+	} else {
+		s.committed[path] -= entry.TorrentBytes
+	}
 }
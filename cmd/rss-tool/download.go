@@ -19,40 +19,31 @@ package main
  */
 
 import (
-	"encoding/json"
 	"fmt"
-	"io/ioutil"
-
-	log "github.com/sirupsen/logrus"
+	"os"
 )
 
 type DownloadCmd struct {
-	Feed    string   `kong:"arg,required,help='Specify feed name to download'"`
-	Filters []string `kong:"arg,optional,help='Specify optional filter to use (default all)'"`
-	Output  string   `kong:"optional,name='output',short='o',default='',help='Output file'"`
-	Append  bool     `kong:"optiona,name='append',short='a',default=false,help='Append to existing output file'"`
+	Feed     string   `kong:"arg,required,help='Specify feed name to download'"`
+	Filters  []string `kong:"arg,optional,help='Specify optional filter to use (default all)'"`
+	Output   string   `kong:"optional,name='output',short='o',default='',help='Output file'"`
+	Append   bool     `kong:"optiona,name='append',short='a',default=false,help='Append to existing output file (json & jsonl only)'"`
+	Format   string   `kong:"optional,name='format',short='f',default='json',enum='${OUTPUT_FORMATS}',help='Output format [${OUTPUT_FORMATS}]'"`
+	Template string   `kong:"optional,name='template',short='t',help='Go template for each entry with --format template'"`
+	Input    string   `kong:"optional,name='input',short='i',help='Read the feed from this file (- for stdin) instead of the network'"`
 }
 
 func (cmd *DownloadCmd) Run(ctx *RunContext) error {
-	outputFile := fmt.Sprintf("%s.json", ctx.Cli.Download.Feed)
+	outputFile := fmt.Sprintf("%s.%s", ctx.Cli.Download.Feed, FormatExtension(ctx.Cli.Download.Format))
 	if ctx.Cli.Download.Output != "" {
 		outputFile = ctx.Cli.Download.Output
 	}
 
 	// get our feed
-	feedType := ctx.Konf.String(fmt.Sprintf("Feeds.%s.FeedType", ctx.Cli.Download.Feed))
-	feed, ok := RSS_FEED_TYPES[feedType]
-	if !ok {
-		return fmt.Errorf("Unknown feed type: %s", feedType)
-	}
-	feed.Reset()
-
-	feedName := fmt.Sprintf("Feeds.%s", ctx.Cli.Download.Feed)
-	err := ctx.Konf.Unmarshal(feedName, feed)
+	feed, err := LoadFeed(ctx.Konf, ctx.Cli.Download.Feed)
 	if err != nil {
 		return err
 	}
-	log.Debugf("Feed: %v", feed)
 
 	// which filters to enable
 	filters := []string{}
@@ -64,7 +55,7 @@ func (cmd *DownloadCmd) Run(ctx *RunContext) error {
 		}
 	}
 
-	newEntries, err := DownloadFeed(ctx.Cli.Download.Feed, feed)
+	newEntries, err := DownloadFeed(ctx.Konf, ctx.Cli.Download.Feed, feed, ctx.Cli.Download.Input)
 	if err != nil {
 		return err
 	}
@@ -76,9 +67,11 @@ func (cmd *DownloadCmd) Run(ctx *RunContext) error {
 
 	oldEntries := []RssFeedEntry{}
 	if ctx.Cli.Download.Append {
-		fileBytes, err := ioutil.ReadFile(outputFile)
+		f, err := os.Open(outputFile)
 		if err == nil {
-			if err = json.Unmarshal(fileBytes, &oldEntries); err != nil {
+			oldEntries, err = ReadEntries(f, ctx.Cli.Download.Format)
+			f.Close()
+			if err != nil {
 				return err
 			}
 		}
@@ -89,6 +82,11 @@ func (cmd *DownloadCmd) Run(ctx *RunContext) error {
 			oldEntries = append(oldEntries, entry)
 		}
 	}
-	fileBytes, _ := json.MarshalIndent(oldEntries, "", "  ")
-	return ioutil.WriteFile(outputFile, fileBytes, 0644)
+
+	f, err := os.Create(outputFile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return WriteEntries(f, ctx.Cli.Download.Format, ctx.Cli.Download.Template, oldEntries)
 }
@@ -0,0 +1,263 @@
+package main
+
+/*
+ * RSS Download Tool
+ * Copyright (c) 2021 Aaron Turner  <aturner at synfin dot net>
+ *
+ * This program is free software: you can redistribute it
+ * and/or modify it under the terms of the GNU General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or with the authors permission any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/knadh/koanf"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	EMAIL               = "Email"
+	EMAIL_TLS_MODES     = "starttls,tls,none"
+	EMAIL_MODES         = "entry,report,both"
+	DEFAULT_EMAIL_TLS   = "starttls"
+	DEFAULT_EMAIL_MODE  = "entry"
+	DEFAULT_REPORT_TIME = "08:00"
+)
+
+// CAs to verify the SMTP server with, nil uses the system roots
+var emailRootCAs *x509.CertPool
+
+// SMTP server & what to send
+type EmailConfig struct {
+	Host       string   `koanf:"Host"`
+	Port       int      `koanf:"Port"` // default 587, or 465 for TLS
+	TLS        string   `koanf:"TLS"`  // starttls, tls or none
+	Username   string   `koanf:"Username"`
+	Password   string   `koanf:"Password"`
+	From       string   `koanf:"From"`
+	To         []string `koanf:"To"`         // when no Users are configured & for the report
+	Mode       string   `koanf:"Mode"`       // entry, report or both
+	ReportTime string   `koanf:"ReportTime"` // HH:MM to send the daily report
+	Timezone   string   `koanf:"Timezone"`   // for ReportTime, default is local time
+}
+
+// Returns the Email config with defaults and if email is enabled
+func LoadEmail(konf *koanf.Koanf) (EmailConfig, bool, error) {
+	ec := EmailConfig{}
+	if !konf.Exists(EMAIL) {
+		return ec, false, nil
+	}
+	if err := konf.Unmarshal(EMAIL, &ec); err != nil {
+		return ec, false, fmt.Errorf("Invalid %s: %s", EMAIL, err)
+	}
+	ec.To = splitStrings(ec.To)
+	if ec.TLS == "" {
+		ec.TLS = DEFAULT_EMAIL_TLS
+	}
+	if ec.Port == 0 {
+		ec.Port = 587
+		if ec.TLS == "tls" {
+			ec.Port = 465
+		}
+	}
+	if ec.Mode == "" {
+		ec.Mode = DEFAULT_EMAIL_MODE
+	}
+	if ec.ReportTime == "" {
+		ec.ReportTime = DEFAULT_REPORT_TIME
+	}
+	return ec, true, nil
+}
+
+// Returns if a message is sent for each entry
+func (ec EmailConfig) SendEntries() bool {
+	return ec.Mode == "entry" || ec.Mode == "both"
+}
+
+// Returns if the daily report is sent
+func (ec EmailConfig) SendReport() bool {
+	return ec.Mode == "report" || ec.Mode == "both"
+}
+
+// Sends the HTML email to each of the addresses
+func (ec EmailConfig) Send(konf *koanf.Koanf, to []string, subject, html string) error {
+	msg, err := ec.message(to, subject, html)
+	if err != nil {
+		return err
+	}
+	retry := LoadRetryPolicy(konf)
+	return retry.Do(fmt.Sprintf("Sending email %s", subject), func() error {
+		return ec.send(to, msg, retry.Timeout)
+	})
+}
+
+// Returns the MIME message
+func (ec EmailConfig) message(to []string, subject, html string) ([]byte, error) {
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", ec.From)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(to, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&msg, "Content-Type: text/html; charset=UTF-8\r\n")
+	fmt.Fprintf(&msg, "Content-Transfer-Encoding: quoted-printable\r\n\r\n")
+	w := quotedprintable.NewWriter(&msg)
+	if _, err := w.Write([]byte(html)); err != nil {
+		return []byte{}, err
+	}
+	if err := w.Close(); err != nil {
+		return []byte{}, err
+	}
+	return msg.Bytes(), nil
+}
+
+// Delivers the message over a single SMTP connection
+func (ec EmailConfig) send(to []string, msg []byte, timeout time.Duration) error {
+	addr := net.JoinHostPort(ec.Host, strconv.Itoa(ec.Port))
+	tlsConfig := &tls.Config{ServerName: ec.Host, RootCAs: emailRootCAs}
+	dialer := &net.Dialer{Timeout: timeout}
+
+	var conn net.Conn
+	var err error
+	if ec.TLS == "tls" {
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return err
+	}
+	if err = conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		conn.Close()
+		return err
+	}
+	c, err := smtp.NewClient(conn, ec.Host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+
+	if ec.TLS == "starttls" {
+		if ok, _ := c.Extension("STARTTLS"); !ok {
+			return fmt.Errorf("%s does not support STARTTLS", addr)
+		}
+		if err = c.StartTLS(tlsConfig); err != nil {
+			return err
+		}
+	}
+	if ec.Username != "" {
+		if err = c.Auth(smtp.PlainAuth("", ec.Username, ec.Password, ec.Host)); err != nil {
+			return err
+		}
+	}
+	if err = c.Mail(ec.From); err != nil {
+		return err
+	}
+	for _, addr := range to {
+		if err = c.Rcpt(addr); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err = w.Write(msg); err != nil {
+		return err
+	}
+	if err = w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// Emails the message SendPush builds about the new entry and returns the
+// names of the Users which were sent it.  If any Users are configured, only
+// the subscribers with an Email address are sent it, otherwise Email.To.
+// Email is always sent straight away: QuietHours, MaxPerHour and Digest
+// only apply to Pushover.
+func SendEmail(konf *koanf.Koanf, entry RssFeedEntry, feed RssFeed) ([]string, error) {
+	notified := []string{}
+	ec, enabled, err := LoadEmail(konf)
+	if err != nil || !enabled || !ec.SendEntries() {
+		return notified, err
+	}
+
+	html := strings.ReplaceAll(strings.TrimSpace(entryMessage(konf, entry, feed)), "\n", "<br>\n")
+	subject := fmt.Sprintf("New %s torrent: %s", entry.FeedName, entry.Title)
+
+	if len(konf.MapKeys(USERS)) == 0 {
+		if err = ec.Send(konf, ec.To, subject, html); err != nil {
+			return notified, fmt.Errorf("Unable to email %s: %w", entry.Title, err)
+		}
+		return notified, nil
+	}
+
+	users, err := Subscribers(konf, entry.FeedName, entry.Filter)
+	if err != nil {
+		return notified, err
+	}
+	for _, user := range users {
+		if user.Email == "" {
+			continue
+		}
+		if err := ec.Send(konf, []string{user.Email}, subject, html); err != nil {
+			log.WithError(err).Errorf("Unable to email %s: %s", user.Name, err)
+			continue
+		}
+		notified = append(notified, user.Name)
+	}
+	return notified, nil
+}
+
+func validateEmail(konf *koanf.Koanf) []string {
+	problems := []string{}
+	ec, enabled, err := LoadEmail(konf)
+	if err != nil {
+		return append(problems, err.Error())
+	} else if !enabled {
+		return problems
+	}
+	if ec.Host == "" {
+		problems = append(problems, fmt.Sprintf("%s.Host: missing", EMAIL))
+	}
+	if ec.From == "" {
+		problems = append(problems, fmt.Sprintf("%s.From: missing", EMAIL))
+	}
+	if !inList(EMAIL_TLS_MODES, ec.TLS) {
+		problems = append(problems, fmt.Sprintf("%s.TLS: invalid mode %s, must be one of %s",
+			EMAIL, ec.TLS, EMAIL_TLS_MODES))
+	}
+	if !inList(EMAIL_MODES, ec.Mode) {
+		problems = append(problems, fmt.Sprintf("%s.Mode: invalid mode %s, must be one of %s",
+			EMAIL, ec.Mode, EMAIL_MODES))
+	}
+	if len(ec.To) == 0 && (ec.SendReport() || len(konf.MapKeys(USERS)) == 0) {
+		problems = append(problems, fmt.Sprintf("%s.To: missing", EMAIL))
+	}
+	if _, err := ec.reportPolicy().NextSend(time.Now()); err != nil {
+		problems = append(problems, fmt.Sprintf("%s.ReportTime: %s", EMAIL, err))
+	}
+	return problems
+}
@@ -0,0 +1,331 @@
+package main
+
+/*
+ * RSS Download Tool
+ * Copyright (c) 2021 Aaron Turner  <aturner at synfin dot net>
+ *
+ * This program is free software: you can redistribute it
+ * and/or modify it under the terms of the GNU General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or with the authors permission any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"math/big"
+	"net"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/knadh/koanf"
+	"github.com/knadh/koanf/providers/confmap"
+)
+
+// What the SMTP stub received in a session
+type smtpSession struct {
+	TLS  bool
+	Auth string // user:password from AUTH PLAIN
+	From string
+	To   []string
+	Data string
+}
+
+// A minimal SMTP server on a random local port
+type smtpStub struct {
+	listener  net.Listener
+	tlsConfig *tls.Config // enables STARTTLS
+	lock      sync.Mutex
+	sessions  []smtpSession
+}
+
+func newSmtpStub(t *testing.T, tlsConfig *tls.Config) *smtpStub {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unable to listen: %s", err)
+	}
+	s := &smtpStub{listener: listener, tlsConfig: tlsConfig}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	t.Cleanup(func() { listener.Close() })
+	return s
+}
+
+func (s *smtpStub) Port() int {
+	return s.listener.Addr().(*net.TCPAddr).Port
+}
+
+func (s *smtpStub) Sessions() []smtpSession {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]smtpSession{}, s.sessions...)
+}
+
+func (s *smtpStub) serve(conn net.Conn) {
+	defer func() { conn.Close() }()
+	session := smtpSession{}
+	tp := textproto.NewConn(conn)
+	tp.PrintfLine("220 stub ESMTP")
+	for {
+		line, err := tp.ReadLine()
+		if err != nil {
+			return
+		}
+		cmd := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+		arg := strings.TrimSpace(strings.TrimPrefix(line, strings.SplitN(line, " ", 2)[0]))
+		switch cmd {
+		case "EHLO", "HELO":
+			if s.tlsConfig != nil && !session.TLS {
+				tp.PrintfLine("250-stub")
+				tp.PrintfLine("250 STARTTLS")
+			} else {
+				tp.PrintfLine("250-stub")
+				tp.PrintfLine("250 AUTH PLAIN")
+			}
+		case "STARTTLS":
+			if s.tlsConfig == nil {
+				tp.PrintfLine("502 not supported")
+				continue
+			}
+			tp.PrintfLine("220 ready")
+			tlsConn := tls.Server(conn, s.tlsConfig)
+			if err := tlsConn.Handshake(); err != nil {
+				return
+			}
+			conn = tlsConn
+			tp = textproto.NewConn(conn)
+			session = smtpSession{TLS: true}
+		case "AUTH":
+			fields := strings.Fields(arg)
+			if len(fields) == 2 && fields[0] == "PLAIN" {
+				b, _ := base64.StdEncoding.DecodeString(fields[1])
+				parts := strings.Split(string(b), "\x00")
+				if len(parts) == 3 {
+					session.Auth = parts[1] + ":" + parts[2]
+				}
+			}
+			tp.PrintfLine("235 ok")
+		case "MAIL":
+			session.From = strings.Trim(strings.TrimPrefix(arg, "FROM:"), "<>")
+			tp.PrintfLine("250 ok")
+		case "RCPT":
+			session.To = append(session.To, strings.Trim(strings.TrimPrefix(arg, "TO:"), "<>"))
+			tp.PrintfLine("250 ok")
+		case "DATA":
+			tp.PrintfLine("354 go ahead")
+			b, err := tp.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			session.Data = string(b)
+			s.lock.Lock()
+			s.sessions = append(s.sessions, session)
+			s.lock.Unlock()
+			tp.PrintfLine("250 queued")
+		case "RSET", "NOOP":
+			tp.PrintfLine("250 ok")
+		case "QUIT":
+			tp.PrintfLine("221 bye")
+			return
+		default:
+			tp.PrintfLine("500 unknown command")
+		}
+	}
+}
+
+// Returns a self-signed certificate for 127.0.0.1 and a pool trusting it
+func testCertificate(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Unable to generate key: %s", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "127.0.0.1"},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Unable to create certificate: %s", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("Unable to parse certificate: %s", err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, pool
+}
+
+// Starts a stub for the TLS mode and returns the EmailConfig to use it
+func testEmailServer(t *testing.T, mode string) (*smtpStub, EmailConfig) {
+	var tlsConfig *tls.Config
+	if mode == "starttls" {
+		cert, pool := testCertificate(t)
+		tlsConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+		emailRootCAs = pool
+		t.Cleanup(func() { emailRootCAs = nil })
+	}
+	stub := newSmtpStub(t, tlsConfig)
+	ec := EmailConfig{
+		Host: "127.0.0.1",
+		Port: stub.Port(),
+		TLS:  mode,
+		From: "rss@example.com",
+		To:   []string{"alice@example.com", "bob@example.com"},
+	}
+	if mode == "starttls" {
+		ec.Username = "rss"
+		ec.Password = "s3cret"
+	}
+	return stub, ec
+}
+
+func TestEmailSend(t *testing.T) {
+	for _, mode := range []string{"none", "starttls"} {
+		t.Run(mode, func(t *testing.T) {
+			stub, ec := testEmailServer(t, mode)
+			msg, err := ec.message(ec.To, "Test ünicode", "<p>Hello</p>")
+			if err != nil {
+				t.Fatalf("Unable to build message: %s", err)
+			}
+			if err = ec.send(ec.To, msg, 5*time.Second); err != nil {
+				t.Fatalf("Unable to send: %s", err)
+			}
+
+			sessions := stub.Sessions()
+			if len(sessions) != 1 {
+				t.Fatalf("Expected 1 message, got %d", len(sessions))
+			}
+			session := sessions[0]
+			if session.TLS != (mode == "starttls") {
+				t.Errorf("TLS = %t for %s", session.TLS, mode)
+			}
+			if mode == "starttls" && session.Auth != "rss:s3cret" {
+				t.Errorf("Auth = %q", session.Auth)
+			}
+			if session.From != ec.From {
+				t.Errorf("From = %q", session.From)
+			}
+			if strings.Join(session.To, ",") != strings.Join(ec.To, ",") {
+				t.Errorf("To = %v", session.To)
+			}
+			headers, err := textproto.NewReader(bufio.NewReader(strings.NewReader(session.Data))).ReadMIMEHeader()
+			if err != nil {
+				t.Fatalf("Unable to read headers: %s", err)
+			}
+			if got := headers.Get("Subject"); got != "=?utf-8?q?Test_=C3=BCnicode?=" {
+				t.Errorf("Subject = %q", got)
+			}
+			if got := headers.Get("Content-Type"); got != "text/html; charset=UTF-8" {
+				t.Errorf("Content-Type = %q", got)
+			}
+			if !strings.Contains(session.Data, "<p>Hello</p>") {
+				t.Errorf("Missing body: %q", session.Data)
+			}
+		})
+	}
+}
+
+func TestEmailSendStartTLSUnsupported(t *testing.T) {
+	stub, ec := testEmailServer(t, "none")
+	ec.TLS = "starttls"
+	msg, _ := ec.message(ec.To, "Test", "Hello")
+	if err := ec.send(ec.To, msg, 5*time.Second); err == nil {
+		t.Errorf("Expected an error without STARTTLS")
+	}
+	if len(stub.Sessions()) != 0 {
+		t.Errorf("Message was sent without STARTTLS")
+	}
+}
+
+func TestSendReport(t *testing.T) {
+	for _, mode := range []string{"none", "starttls"} {
+		t.Run(mode, func(t *testing.T) {
+			stub, ec := testEmailServer(t, mode)
+			konf := koanf.New(".")
+			err := konf.Load(confmap.Provider(map[string]interface{}{
+				"Email.Host":     ec.Host,
+				"Email.Port":     ec.Port,
+				"Email.TLS":      ec.TLS,
+				"Email.Username": ec.Username,
+				"Email.Password": ec.Password,
+				"Email.From":     ec.From,
+				"Email.To":       strings.Join(ec.To, ","),
+				"Email.Mode":     "report",
+			}, "."), nil)
+			if err != nil {
+				t.Fatalf("Unable to load config: %s", err)
+			}
+
+			now := time.Date(2023, 4, 2, 8, 0, 0, 0, time.UTC)
+			cache := &CacheFile{
+				Activity: []WebhookEvent{
+					{Event: EVENT_MATCH, Time: now.Add(-time.Hour), Feed: "tv",
+						Entry: &RssFeedEntry{Title: "Show.Name.S01E01.1080p", FeedName: "tv"}},
+					{Event: EVENT_FEED_ERROR, Time: now.Add(-time.Hour), Feed: "broken",
+						Error: "connection refused"},
+				},
+			}
+			if err = SendReport(konf, cache, now); err != nil {
+				t.Fatalf("Unable to send report: %s", err)
+			}
+
+			sessions := stub.Sessions()
+			if len(sessions) != 1 {
+				t.Fatalf("Expected 1 message, got %d", len(sessions))
+			}
+			session := sessions[0]
+			if session.TLS != (mode == "starttls") {
+				t.Errorf("TLS = %t for %s", session.TLS, mode)
+			}
+			if len(session.To) != 2 {
+				t.Errorf("To = %v", session.To)
+			}
+			if !strings.Contains(session.Data, "Subject: RSS report for 2023-04-02") {
+				t.Errorf("Missing subject: %q", session.Data)
+			}
+			for _, want := range []string{"Show.Name.S01E01.1080p", "connection refused"} {
+				if !strings.Contains(strings.ReplaceAll(session.Data, "=\r\n", ""), want) {
+					t.Errorf("Report is missing %s", want)
+				}
+			}
+			if len(cache.Activity) != 0 {
+				t.Errorf("Activity wasn't cleared: %v", cache.Activity)
+			}
+			if !cache.LastReport.Equal(now) {
+				t.Errorf("LastReport = %s", cache.LastReport)
+			}
+		})
+	}
+}
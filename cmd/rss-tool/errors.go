@@ -0,0 +1,216 @@
+package main
+
+/*
+ * RSS Download Tool
+ * Copyright (c) 2021 Aaron Turner  <aturner at synfin dot net>
+ *
+ * This program is free software: you can redistribute it
+ * and/or modify it under the terms of the GNU General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or with the authors permission any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/knadh/koanf"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	ERROR_POLICY            = "ErrorPolicy"
+	DEFAULT_ERROR_HOLD_DOWN = ERROR_HOLD_DOWN * time.Hour
+	DEFAULT_ERROR_MAX_HOLD  = 7 * 24 * time.Hour
+	ERROR_TIME_FORMAT       = "2006-01-02 15:04"
+)
+
+// How often to notify about errors downloading/notifying an entry
+type ErrorPolicy struct {
+	HoldDown    time.Duration `koanf:"HoldDown"`    // between notifications, default 4h
+	Backoff     float64       `koanf:"Backoff"`     // multiply HoldDown by this after each notification
+	MaxHoldDown time.Duration `koanf:"MaxHoldDown"` // longest HoldDown with Backoff, default 7 days
+	GiveUpAfter int           `koanf:"GiveUpAfter"` // stop trying the entry after this many errors
+}
+
+// An error downloading/notifying an entry
+type ErrorRecord struct {
+	Feed      string    `json:"Feed,omitempty" yaml:"Feed,omitempty"`
+	Message   string    `json:"Message" yaml:"Message"`
+	FirstSeen time.Time `json:"FirstSeen" yaml:"FirstSeen"`
+	LastSeen  time.Time `json:"LastSeen" yaml:"LastSeen"`
+	Count     int       `json:"Count" yaml:"Count"`
+	Notified  int       `json:"Notified" yaml:"Notified"`   // number of notifications sent
+	HoldUntil time.Time `json:"HoldUntil" yaml:"HoldUntil"` // no notifications until then
+	Failed    bool      `json:"Failed" yaml:"Failed"`       // we gave up on the entry
+}
+
+// An ErrorRecord and the entry it is for, used by the `errors` command
+type ErrorEntry struct {
+	Title       string `json:"Title" yaml:"Title"`
+	Status      string `json:"Status" yaml:"Status"`
+	ErrorRecord `yaml:",inline"`
+}
+
+// Reads an ErrorRecord or the expiry time used by older caches
+func (er *ErrorRecord) UnmarshalJSON(b []byte) error {
+	var expire int64
+	if err := json.Unmarshal(b, &expire); err == nil {
+		er.HoldUntil = time.Unix(expire, 0)
+		er.FirstSeen = er.HoldUntil.Add(-DEFAULT_ERROR_HOLD_DOWN)
+		er.LastSeen = er.FirstSeen
+		er.Count = 1
+		er.Notified = 1
+		return nil
+	}
+	type record ErrorRecord // avoid recursion
+	return json.Unmarshal(b, (*record)(er))
+}
+
+// Returns the global ErrorPolicy overridden by any values set for the feed
+func LoadErrorPolicy(konf *koanf.Koanf, feed RssFeed) ErrorPolicy {
+	policy := ErrorPolicy{}
+	if err := konf.Unmarshal(ERROR_POLICY, &policy); err != nil {
+		log.WithError(err).Errorf("Invalid %s", ERROR_POLICY)
+	}
+	if feed != nil {
+		if fp := feed.GetErrorPolicy(); fp != nil {
+			if fp.HoldDown > 0 {
+				policy.HoldDown = fp.HoldDown
+			}
+			if fp.Backoff > 0 {
+				policy.Backoff = fp.Backoff
+			}
+			if fp.MaxHoldDown > 0 {
+				policy.MaxHoldDown = fp.MaxHoldDown
+			}
+			if fp.GiveUpAfter > 0 {
+				policy.GiveUpAfter = fp.GiveUpAfter
+			}
+		}
+	}
+	if policy.HoldDown <= 0 {
+		policy.HoldDown = DEFAULT_ERROR_HOLD_DOWN
+	}
+	if policy.MaxHoldDown <= 0 {
+		policy.MaxHoldDown = DEFAULT_ERROR_MAX_HOLD
+	}
+	return policy
+}
+
+// Returns how long to hold down notifications after the given number of
+// notifications have been sent
+func (ep ErrorPolicy) holdDown(notified int) time.Duration {
+	if ep.Backoff <= 1 || notified <= 1 {
+		return ep.HoldDown
+	}
+	hold := float64(ep.HoldDown) * math.Pow(ep.Backoff, float64(notified-1))
+	if hold > float64(ep.MaxHoldDown) {
+		return ep.MaxHoldDown
+	}
+	return time.Duration(hold)
+}
+
+// Records an error for the entry.  Returns the error to notify about or
+// nil if notifications are held down.
+func (c *CacheFile) RecordError(feedName, title string, err error, policy ErrorPolicy) error {
+	now := time.Now()
+	record, ok := c.Errors[title]
+	if !ok {
+		record = &ErrorRecord{FirstSeen: now}
+		c.Errors[title] = record
+	}
+	record.Feed = feedName
+	record.Message = err.Error()
+	record.LastSeen = now
+	record.Count++
+
+	if policy.GiveUpAfter > 0 && record.Count >= policy.GiveUpAfter {
+		record.Failed = true
+		record.Notified++
+		return fmt.Errorf("Giving up on %s after %d errors: %s", title, record.Count, err)
+	}
+
+	if now.Before(record.HoldUntil) {
+		return nil
+	}
+	record.Notified++
+	record.HoldUntil = now.Add(policy.holdDown(record.Notified))
+	return err
+}
+
+// Clears any error for the entry
+func (c *CacheFile) ClearError(title string) {
+	delete(c.Errors, title)
+}
+
+// Returns true if we gave up on the entry
+func (c *CacheFile) HasFailed(title string) bool {
+	record, ok := c.Errors[title]
+	return ok && record.Failed
+}
+
+type ErrorsCmd struct {
+	Cache    string   `kong:"optional,name='cache',short='c',default='${CACHE_FILE}',help='Cache file'"`
+	Format   string   `kong:"optional,name='format',short='f',default='table',enum='${OUTPUT_FORMATS}',help='Output format [${OUTPUT_FORMATS}]'"`
+	Template string   `kong:"optional,name='template',short='t',help='Go template for each error with --format template'"`
+	Clear    []string `kong:"optional,name='clear',help='Clear the errors for these entries so they are retried'"`
+	ClearAll bool     `kong:"optional,name='clear-all',help='Clear all the errors'"`
+}
+
+func (cmd *ErrorsCmd) Run(ctx *RunContext) error {
+	cache, err := OpenCache(cmd.Cache, CacheLockTimeout(ctx.Konf))
+	if err != nil {
+		return fmt.Errorf("Unable to open cache %s: %s", cmd.Cache, err)
+	}
+	defer cache.Close()
+
+	if cmd.ClearAll || len(cmd.Clear) > 0 {
+		for _, title := range cmd.Clear {
+			if _, ok := cache.Errors[title]; !ok {
+				return fmt.Errorf("No error for %s", title)
+			}
+			cache.ClearError(title)
+		}
+		if cmd.ClearAll {
+			cache.Errors = map[string]*ErrorRecord{}
+		}
+		return cache.SaveCache()
+	}
+
+	return WriteErrors(os.Stdout, cmd.Format, cmd.Template, cache.ErrorEntries())
+}
+
+// Returns the errors in the cache, most recent first
+func (c *CacheFile) ErrorEntries() []ErrorEntry {
+	entries := []ErrorEntry{}
+	for title, record := range c.Errors {
+		status := "retrying"
+		if record.Failed {
+			status = "failed"
+		} else if record.HoldUntil.After(time.Now()) {
+			status = "held until " + record.HoldUntil.Local().Format(ERROR_TIME_FORMAT)
+		}
+		entries = append(entries, ErrorEntry{
+			Title:       title,
+			Status:      status,
+			ErrorRecord: *record,
+		})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].LastSeen.After(entries[j].LastSeen)
+	})
+	return entries
+}
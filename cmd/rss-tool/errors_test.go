@@ -0,0 +1,158 @@
+package main
+
+/*
+ * RSS Download Tool
+ * Copyright (c) 2021 Aaron Turner  <aturner at synfin dot net>
+ *
+ * This program is free software: you can redistribute it
+ * and/or modify it under the terms of the GNU General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or with the authors permission any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestErrorPolicyHoldDown(t *testing.T) {
+	policy := ErrorPolicy{HoldDown: time.Hour, Backoff: 2, MaxHoldDown: 6 * time.Hour}
+	tests := []struct {
+		notified int
+		hold     time.Duration
+	}{
+		{0, time.Hour},
+		{1, time.Hour},
+		{2, 2 * time.Hour},
+		{3, 4 * time.Hour},
+		{4, 6 * time.Hour},
+		{50, 6 * time.Hour},
+	}
+	for _, test := range tests {
+		if hold := policy.holdDown(test.notified); hold != test.hold {
+			t.Errorf("holdDown(%d) = %s, expected %s", test.notified, hold, test.hold)
+		}
+	}
+
+	// no Backoff always uses HoldDown
+	policy.Backoff = 0
+	if hold := policy.holdDown(5); hold != time.Hour {
+		t.Errorf("holdDown(5) without Backoff = %s, expected %s", hold, time.Hour)
+	}
+}
+
+func TestRecordError(t *testing.T) {
+	cache := &CacheFile{Errors: map[string]*ErrorRecord{}}
+	policy := ErrorPolicy{HoldDown: time.Hour, Backoff: 2, MaxHoldDown: 24 * time.Hour}
+	title := "Show.Name.S01E01.1080p"
+	fail := errors.New("connection refused")
+
+	start := time.Now()
+	if err := cache.RecordError("tv", title, fail, policy); err != fail {
+		t.Fatalf("First RecordError() = %v, expected %v", err, fail)
+	}
+	record := cache.Errors[title]
+	if record.Count != 1 || record.Notified != 1 || record.Feed != "tv" || record.Message != fail.Error() {
+		t.Errorf("Unexpected record: %+v", *record)
+	}
+	if hold := record.HoldUntil.Sub(start); hold < time.Hour || hold > time.Hour+time.Minute {
+		t.Errorf("HoldUntil is %s after the first error, expected %s", hold, time.Hour)
+	}
+
+	// held down
+	if err := cache.RecordError("tv", title, fail, policy); err != nil {
+		t.Errorf("Second RecordError() = %v, expected nil", err)
+	}
+	if record.Count != 2 || record.Notified != 1 {
+		t.Errorf("Count = %d, Notified = %d after being held down", record.Count, record.Notified)
+	}
+
+	// hold down expired, so notify again & back off
+	record.HoldUntil = time.Now().Add(-time.Second)
+	start = time.Now()
+	if err := cache.RecordError("tv", title, fail, policy); err != fail {
+		t.Errorf("Third RecordError() = %v, expected %v", err, fail)
+	}
+	if hold := record.HoldUntil.Sub(start); hold < 2*time.Hour || hold > 2*time.Hour+time.Minute {
+		t.Errorf("HoldUntil is %s after the second notification, expected %s", hold, 2*time.Hour)
+	}
+	if record.Failed || cache.HasFailed(title) {
+		t.Errorf("Entry failed without GiveUpAfter")
+	}
+
+	// GiveUpAfter notifies even when held down
+	policy.GiveUpAfter = 4
+	err := cache.RecordError("tv", title, fail, policy)
+	if err == nil || !strings.Contains(err.Error(), "Giving up") {
+		t.Errorf("RecordError() = %v, expected to give up", err)
+	}
+	if !cache.HasFailed(title) {
+		t.Errorf("HasFailed() = false after giving up")
+	}
+
+	cache.ClearError(title)
+	if _, ok := cache.Errors[title]; ok {
+		t.Errorf("ClearError() didn't remove the record")
+	}
+}
+
+func TestErrorRecordUnmarshalJSON(t *testing.T) {
+	legacy := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	data := `{
+		"old": 1622548800,
+		"new": {"Feed": "tv", "Message": "boom", "FirstSeen": "2021-05-01T00:00:00Z",
+			"LastSeen": "2021-05-02T00:00:00Z", "Count": 3, "Notified": 2,
+			"HoldUntil": "2021-05-03T00:00:00Z", "Failed": true}
+	}`
+	records := map[string]*ErrorRecord{}
+	if err := json.Unmarshal([]byte(data), &records); err != nil {
+		t.Fatalf("Unable to unmarshal: %s", err)
+	}
+
+	old := records["old"]
+	if old == nil {
+		t.Fatalf("Missing legacy record")
+	}
+	if !old.HoldUntil.Equal(legacy) {
+		t.Errorf("HoldUntil = %s, expected %s", old.HoldUntil, legacy)
+	}
+	if !old.FirstSeen.Equal(legacy.Add(-DEFAULT_ERROR_HOLD_DOWN)) || !old.LastSeen.Equal(old.FirstSeen) {
+		t.Errorf("FirstSeen = %s, LastSeen = %s", old.FirstSeen, old.LastSeen)
+	}
+	if old.Count != 1 || old.Notified != 1 || old.Failed {
+		t.Errorf("Unexpected legacy record: %+v", *old)
+	}
+
+	record := records["new"]
+	if record == nil {
+		t.Fatalf("Missing record")
+	}
+	expected := ErrorRecord{
+		Feed:      "tv",
+		Message:   "boom",
+		FirstSeen: time.Date(2021, 5, 1, 0, 0, 0, 0, time.UTC),
+		LastSeen:  time.Date(2021, 5, 2, 0, 0, 0, 0, time.UTC),
+		Count:     3,
+		Notified:  2,
+		HoldUntil: time.Date(2021, 5, 3, 0, 0, 0, 0, time.UTC),
+		Failed:    true,
+	}
+	if *record != expected {
+		t.Errorf("Unmarshal = %+v, expected %+v", *record, expected)
+	}
+
+	if err := json.Unmarshal([]byte(`{"bad": "soon"}`), &records); err == nil {
+		t.Errorf("Expected an error for an invalid record")
+	}
+}
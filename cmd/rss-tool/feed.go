@@ -19,23 +19,30 @@ package main
  */
 
 import (
+	"bytes"
 	"fmt"
+	"io/ioutil"
+	"os"
 	"reflect"
 	"regexp"
 	"strconv"
 	"strings"
 	"time"
 
+	"github.com/knadh/koanf"
 	"github.com/mmcdole/gofeed"
 	log "github.com/sirupsen/logrus"
 )
 
 const (
-	RSS_PARAM_TAG = "param"
+	RSS_PARAM_TAG    = "param"
+	STDIN_FEED       = "-"
+	FILE_FEED_PREFIX = "file://"
 )
 
-var RSS_FEED_TYPES = map[string]RssFeed{
-	"RFM": &RfmFeed{},
+// Constructors for each FeedType, so every feed gets its own instance
+var RSS_FEED_TYPES = map[string]func() RssFeed{
+	"RFM": NewRfmFeed,
 }
 
 // generic RSS entry filter
@@ -43,38 +50,68 @@ type RssFilter struct {
 	Search       []string `koanf:"Search"`     // regexps
 	Exclude      []string `koanf:"Exclude"`    // regexps
 	Categories   []string `koanf:"Categories"` // any valid category
+	MinSize      string   `koanf:"MinSize"`    // ignore smaller torrents
+	MaxSize      string   `koanf:"MaxSize"`    // ignore larger torrents
 	compiled     bool
 	match        []*regexp.Regexp
 	exclude      []*regexp.Regexp
-	AutoDownload bool `koanf:"AutoDownload"`
+	minBytes     uint64
+	maxBytes     uint64
+	AutoDownload bool             `koanf:"AutoDownload"`
+	Pushover     *PushoverOptions `koanf:"Pushover"` // overrides the feed settings
+}
+
+// Compiles the Search & Exclude regexps.  Invalid regexps are skipped
+// when matching and reported via the returned error.
+func (rf *RssFilter) Compile() error {
+	errs := []string{}
+	rf.match = []*regexp.Regexp{}
+	rf.exclude = []*regexp.Regexp{}
+	for i, search := range rf.Search {
+		r, err := regexp.Compile(search)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("search regexp #%d `%s`: %s", i, search, err))
+		}
+		rf.match = append(rf.match, r)
+	}
+	for i, search := range rf.Exclude {
+		r, err := regexp.Compile(search)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("exclude regexp #%d `%s`: %s", i, search, err))
+		}
+		rf.exclude = append(rf.exclude, r)
+	}
+	var err error
+	if rf.minBytes, err = ParseBytes(rf.MinSize); err != nil {
+		errs = append(errs, fmt.Sprintf("MinSize: %s", err))
+	}
+	if rf.maxBytes, err = ParseBytes(rf.MaxSize); err != nil {
+		errs = append(errs, fmt.Sprintf("MaxSize: %s", err))
+	}
+	rf.compiled = true
+	if len(errs) > 0 {
+		return fmt.Errorf("Unable to compile %s", strings.Join(errs, "; "))
+	}
+	return nil
 }
 
 // Does the RssFilter have a search regexp which matches the check string?
 func (rf *RssFilter) Match(check string) bool {
+	search, exclude := rf.Check(check)
+	return search != "" && exclude == ""
+}
+
+// Returns the first search regexp which matches the check string and the
+// first exclude regexp which vetoes it.  Either may be empty.
+func (rf *RssFilter) Check(check string) (string, string) {
 	if !rf.compiled {
-		for i, search := range rf.Search {
-			r, err := regexp.Compile(search)
-			if err != nil {
-				log.WithError(err).Errorf("Unable to compile search regexp #%d: %s", i, search)
-				rf.match = append(rf.match, nil)
-			} else {
-				rf.match = append(rf.match, r)
-			}
-		}
-		for i, search := range rf.Exclude {
-			r, err := regexp.Compile(search)
-			if err != nil {
-				log.WithError(err).Errorf("Unable to compile exclude regexp #%d: %s", i, search)
-				rf.exclude = append(rf.exclude, nil)
-			} else {
-				rf.exclude = append(rf.exclude, r)
-			}
+		if err := rf.Compile(); err != nil {
+			log.WithError(err).Errorf("Invalid filter")
 		}
-		rf.compiled = true
 	}
 
 	// first look for the matches
-	ret := false
+	search := ""
 	for i, match := range rf.match {
 		if match == nil {
 			continue
@@ -83,10 +120,13 @@ func (rf *RssFilter) Match(check string) bool {
 		match := match.Find([]byte(check))
 		if match != nil {
 			log.Debugf("Matched %s => %s", rf.Search[i], check)
-			ret = true // match
+			search = rf.Search[i]
 			break
 		}
 	}
+	if search == "" {
+		return "", ""
+	}
 
 	// then ignore any excludes
 	for i, match := range rf.exclude {
@@ -97,11 +137,32 @@ func (rf *RssFilter) Match(check string) bool {
 		match := match.Find([]byte(check))
 		if match != nil {
 			log.Debugf("Exclude %s => %s", rf.Exclude[i], check)
-			ret = false // match
-			break
+			return search, rf.Exclude[i]
 		}
 	}
-	return ret
+	return search, ""
+}
+
+// Is the torrent size within our MinSize/MaxSize?  Unknown (zero) sizes
+// always pass.
+func (rf *RssFilter) CheckSize(bytes uint64) bool {
+	if !rf.compiled {
+		if err := rf.Compile(); err != nil {
+			log.WithError(err).Errorf("Invalid filter")
+		}
+	}
+	if bytes == 0 {
+		return true
+	}
+	if rf.minBytes > 0 && bytes < rf.minBytes {
+		log.Debugf("Size %s is smaller than MinSize %s", FormatBytes(bytes), rf.MinSize)
+		return false
+	}
+	if rf.maxBytes > 0 && bytes > rf.maxBytes {
+		log.Debugf("Size %s is larger than MaxSize %s", FormatBytes(bytes), rf.MaxSize)
+		return false
+	}
+	return true
 }
 
 // Does the RssFilter have the given category?
@@ -116,18 +177,158 @@ func (rf *RssFilter) HasCategory(category string) bool {
 
 // Define the interface for the RSS Feed Filter
 type RssFeed interface {
-	Reset()
 	GetFeedType() string
 	GetOrder() int
+	GetInterval() time.Duration
 	GetAutoDownload() bool
 	GetDownloadPath() string
-	DownloadFilename(string, RssFeedEntry) string
+	DownloadFilename(string, RssFeedEntry) (string, error)
 	GetParam(string) (string, error)
 	GenerateUrl() string
-	GetPublishFormat() string
+	GetPublishFormats() []string
+	GetLocation() *time.Location
 	UrlRewriter(string) string
 	Match(RssFeedEntry) (bool, string)
+	Explain(RssFeedEntry) []FilterResult
 	GetFilters() map[string]RssFilter
+	GetErrorPolicy() *ErrorPolicy
+	GetPushover() *PushoverOptions
+}
+
+// Loads the named feed from our config into the appropriate RssFeed type
+func LoadFeed(konf *koanf.Koanf, feedName string) (RssFeed, error) {
+	feedPath := fmt.Sprintf("Feeds.%s", feedName)
+	if !konf.Exists(feedPath) {
+		return nil, fmt.Errorf("Invalid feed name: %s", feedName)
+	}
+	feedKonf, err := feedConfig(konf, feedPath)
+	if err != nil {
+		return nil, err
+	}
+	feedType := feedKonf.String("FeedType")
+	if feedType == "" {
+		return nil, fmt.Errorf("Missing FeedType for %s", feedName)
+	}
+	newFeed, ok := RSS_FEED_TYPES[feedType]
+	if !ok {
+		return nil, fmt.Errorf("Unknown feed type: %s", feedType)
+	}
+	feed := newFeed()
+
+	if err := feedKonf.Unmarshal("", feed); err != nil {
+		return nil, err
+	}
+	log.Debugf("Feed: %v", feed)
+	return feed, nil
+}
+
+// Returns the config for the feed or template at the given path with
+// any `Extends` templates merged in underneath it
+func feedConfig(konf *koanf.Koanf, path string) (*koanf.Koanf, error) {
+	return extendConfig(konf, path, []string{})
+}
+
+func extendConfig(konf *koanf.Koanf, path string, seen []string) (*koanf.Koanf, error) {
+	merged := koanf.New(".")
+	if template := konf.String(path + "." + EXTENDS); template != "" {
+		for _, s := range seen {
+			if s == template {
+				return merged, fmt.Errorf("Template loop: %s => %s", strings.Join(seen, " => "), template)
+			}
+		}
+		templatePath := fmt.Sprintf("%s.%s", TEMPLATES, template)
+		if !konf.Exists(templatePath) {
+			return merged, fmt.Errorf("Unknown template: %s", template)
+		}
+		base, err := extendConfig(konf, templatePath, append(seen, template))
+		if err != nil {
+			return merged, err
+		}
+		if err = merged.Merge(base); err != nil {
+			return merged, err
+		}
+	}
+	if err := merged.Merge(konf.Cut(path)); err != nil {
+		return merged, err
+	}
+	merged.Delete(EXTENDS)
+	return merged, nil
+}
+
+// Returns the list of feeds to process.  If feedName is set, just that feed,
+// otherwise all the feeds sorted by their Order.
+func SortedFeeds(konf *koanf.Koanf, feedName string) ([]string, error) {
+	allFeeds := konf.MapKeys("Feeds")
+	feeds := []string{}
+
+	if feedName != "" {
+		for _, feed := range allFeeds {
+			if feed == feedName {
+				return append(feeds, feedName), nil
+			}
+		}
+		return feeds, fmt.Errorf("Invalid feed name: %s", feedName)
+	}
+
+	orders := map[string]int{}
+	for _, feed := range allFeeds {
+		if feedKonf, err := feedConfig(konf, "Feeds."+feed); err == nil {
+			orders[feed] = feedKonf.Int("Order")
+		}
+	}
+
+	// add our feeds in the specified order
+	feedCnt := len(allFeeds)
+	for i := 1; i <= feedCnt; i++ {
+		for _, feed := range allFeeds {
+			if orders[feed] == i {
+				feeds = append(feeds, feed)
+			}
+		}
+	}
+
+	// look for any feeds which don't have an order
+	for _, feed := range allFeeds {
+		hasOrder := false
+		for _, x := range feeds {
+			if feed == x {
+				hasOrder = true
+				break
+			}
+		}
+		if !hasOrder {
+			feeds = append(feeds, feed)
+		}
+	}
+	return feeds, nil
+}
+
+// Explains how a single filter handled an entry
+type FilterResult struct {
+	Filter     string `json:"Filter"`
+	Match      bool   `json:"Match"`
+	CategoryOK bool   `json:"CategoryOK"`
+	SizeOK     bool   `json:"SizeOK"`
+	Category   string `json:"Category,omitempty"` // entry category accepted by the filter
+	Field      string `json:"Field,omitempty"`    // entry field the search regexp hit
+	Search     string `json:"Search,omitempty"`   // search regexp which hit
+	Exclude    string `json:"Exclude,omitempty"`  // exclude regexp which vetoed the hit
+}
+
+// returns the result as a pretty string
+func (fr *FilterResult) Sprint() string {
+	switch {
+	case fr.Match:
+		return fmt.Sprintf("%s: MATCH category `%s`, search `%s` hit %s", fr.Filter, fr.Category, fr.Search, fr.Field)
+	case !fr.CategoryOK:
+		return fmt.Sprintf("%s: no match, category check failed", fr.Filter)
+	case !fr.SizeOK:
+		return fmt.Sprintf("%s: no match, size is outside of MinSize/MaxSize", fr.Filter)
+	case fr.Exclude != "":
+		return fmt.Sprintf("%s: no match, search `%s` hit %s but exclude `%s` vetoed it", fr.Filter, fr.Search, fr.Field, fr.Exclude)
+	default:
+		return fmt.Sprintf("%s: no match, no search regexp hit", fr.Filter)
+	}
 }
 
 func GetParamTag(v reflect.Value, fieldName string) (string, error) {
@@ -141,17 +342,24 @@ func GetParamTag(v reflect.Value, fieldName string) (string, error) {
 
 // Represents a single RSS Feed Entry
 type RssFeedEntry struct {
-	FeedName          string    `json:"FeedName"`
-	Title             string    `json:"Title"`
-	Published         time.Time `json:"Published"`
-	Categories        []string  `json:"Categories"`
-	Description       string    `json:"Description"`
-	Url               string    `json:"Url"`
-	TorrentUrl        string    `json:"TorrentUrl"`
-	TorrentBytes      uint64    `json:"TorrentBytes"`
-	TorrentSize       string    `json:"TorrentSize"`
-	TorrentCategories []string  `json:"TorrentCategories"`
-	AutoDownload      bool
+	FeedName          string    `json:"FeedName" yaml:"FeedName"`
+	Title             string    `json:"Title" yaml:"Title"`
+	Published         time.Time `json:"Published" yaml:"Published"`
+	Categories        []string  `json:"Categories" yaml:"Categories"`
+	Description       string    `json:"Description" yaml:"Description"`
+	Url               string    `json:"Url" yaml:"Url"`
+	TorrentUrl        string    `json:"TorrentUrl" yaml:"TorrentUrl"`
+	TorrentBytes      uint64    `json:"TorrentBytes" yaml:"TorrentBytes"`
+	TorrentSize       string    `json:"TorrentSize" yaml:"TorrentSize"`
+	TorrentCategories []string  `json:"TorrentCategories" yaml:"TorrentCategories"`
+	AutoDownload      bool      `yaml:"AutoDownload"`
+	Filter            string    `json:"Filter,omitempty" yaml:"Filter,omitempty"`     // name of the matching filter
+	Notified          []string  `json:"Notified,omitempty" yaml:"Notified,omitempty"` // Users sent a notification
+}
+
+// Returns the series name of the entry for templates
+func (rfe RssFeedEntry) Series() string {
+	return SeriesName(rfe.Title)
 }
 
 // returns an entry as a pretty string
@@ -164,73 +372,208 @@ func (rfe *RssFeedEntry) Sprint() string {
 	ret = fmt.Sprintf("%s\n\tTorrent: %s [%d]", ret, rfe.TorrentUrl, rfe.TorrentBytes)
 	ret = fmt.Sprintf("%s\n\tTorrent Categories: %s", ret, strings.Join(rfe.TorrentCategories, ", "))
 	ret = fmt.Sprintf("%s\n\tTorrent Size: %s\n", ret, rfe.TorrentSize)
+	if rfe.Filter != "" {
+		ret = fmt.Sprintf("%s\tFilter: %s\n", ret, rfe.Filter)
+	}
+	if len(rfe.Notified) > 0 {
+		ret = fmt.Sprintf("%s\tNotified: %s\n", ret, strings.Join(rfe.Notified, ", "))
+	}
 	return ret
 }
 
-func DownloadFeed(feedname string, rssFeed RssFeed) ([]RssFeedEntry, error) {
+// Downloads & parses the feed.  If input is set, the feed is read from that
+// file (or stdin for `-`) instead of the URL generated by the feed.
+func DownloadFeed(konf *koanf.Koanf, feedname string, rssFeed RssFeed, input string) ([]RssFeedEntry, error) {
 	ret := []RssFeedEntry{}
+	if input != "" {
+		return ReadFeedFile(feedname, rssFeed, input)
+	}
+
 	url := rssFeed.GenerateUrl()
 	log.Debugf("RSS Feed URL = %s", url)
+	if IsLocalFeed(url) {
+		return ReadFeedFile(feedname, rssFeed, url)
+	}
+
+	retry := LoadRetryPolicy(konf)
 	fp := gofeed.NewParser()
+	fp.Client = retry.Client()
+	var feed *gofeed.Feed
+	err := retry.Do(fmt.Sprintf("Loading %s", feedname), func() error {
+		var err error
+		feed, err = fp.ParseURL(url)
+		return err
+	})
+	if err != nil {
+		return ret, fmt.Errorf("Unable to load %s: %w", redactUrl(url), err)
+	}
+	return FeedEntries(feedname, rssFeed, feed)
+}
 
-	feed, err := fp.ParseURL(url)
+// Returns true if the feed url refers to a local file or stdin
+func IsLocalFeed(url string) bool {
+	return url == STDIN_FEED || strings.HasPrefix(url, FILE_FEED_PREFIX)
+}
+
+// Reads the entries from a saved feed document or `download` JSON/JSONL
+// file.  Path may be a file:// URL or `-` for stdin.
+func ReadFeedFile(feedname string, rssFeed RssFeed, path string) ([]RssFeedEntry, error) {
+	var data []byte
+	var err error
+	if path == STDIN_FEED {
+		data, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		path = strings.TrimPrefix(path, FILE_FEED_PREFIX)
+		data, err = ioutil.ReadFile(GetPath(path))
+	}
+	if err != nil {
+		return []RssFeedEntry{}, err
+	}
+
+	switch trimmed := bytes.TrimSpace(data); {
+	case bytes.HasPrefix(trimmed, []byte("[")):
+		return ReadEntries(bytes.NewReader(trimmed), "json")
+	case bytes.HasPrefix(trimmed, []byte("{")):
+		return ReadEntries(bytes.NewReader(trimmed), "jsonl")
+	}
+
+	feed, err := gofeed.NewParser().Parse(bytes.NewReader(data))
 	if err != nil {
-		return ret, fmt.Errorf("Unable to load %s", url)
+		return []RssFeedEntry{}, fmt.Errorf("Unable to parse %s: %s", path, err)
 	}
+	return FeedEntries(feedname, rssFeed, feed)
+}
 
-	for _, item := range feed.Items {
-		t, err := time.Parse(rssFeed.GetPublishFormat(), item.Published)
+// Converts the items in the parsed feed into RssFeedEntry's.  Malformed
+// items are logged and skipped without affecting the rest of the feed.
+func FeedEntries(feedname string, rssFeed RssFeed, feed *gofeed.Feed) ([]RssFeedEntry, error) {
+	ret := []RssFeedEntry{}
+	fetched := time.Now()
+	badDates := 0
+	badItems := 0
+	for i, item := range feed.Items {
+		entry, dateOk, err := feedEntry(feedname, rssFeed, item, fetched)
 		if err != nil {
-			return ret, fmt.Errorf("Unable to parse Published time `%s` with format `%s`: %s",
-				item.Published, rssFeed.GetPublishFormat(), err)
+			log.WithError(err).Warnf("%s: skipping item #%d", feedname, i)
+			badItems++
+			continue
+		}
+		if !dateOk {
+			badDates++
+		}
+		ret = append(ret, entry)
+	}
+
+	if badDates > 0 {
+		log.Warnf("%s: %d of %d items had an unparsable Published time", feedname, badDates, len(feed.Items))
+	}
+	if badItems > 0 {
+		log.Warnf("%s: skipped %d of %d malformed items", feedname, badItems, len(feed.Items))
+	}
+	METRICS.Set(METRIC_FEED_ITEMS, feedname, uint64(len(feed.Items)))
+	METRICS.Set(METRIC_FEED_BAD_DATES, feedname, uint64(badDates))
+	METRICS.Set(METRIC_FEED_BAD_ITEMS, feedname, uint64(badItems))
+	return ret, nil
+}
+
+// Converts a single feed item into an RssFeedEntry.  Returns false if the
+// Published time was unparsable and the fetch time was used instead.
+func feedEntry(feedname string, rssFeed RssFeed, item *gofeed.Item, fetched time.Time) (entry RssFeedEntry, dateOk bool, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("Unable to process item: %v", r)
 		}
+	}()
 
-		// figure out torrent info
-		torrentUrl := ""
-		torrentBytes := uint64(0)
-
-		for _, enclosure := range item.Enclosures {
-			if enclosure.Type == "application/x-bittorrent" {
-				torrentUrl = enclosure.URL
-				torrentBytes, err = strconv.ParseUint(enclosure.Length, 10, 64)
-				if err != nil {
-					return ret, fmt.Errorf("Unable to parse Torrent Bytes `%s`: %s",
-						enclosure.Length, err)
+	if item == nil || item.Title == "" {
+		return entry, false, fmt.Errorf("Item is missing a Title")
+	}
+
+	t, dateOk := ParsePublished(rssFeed, item)
+	if !dateOk {
+		log.Warnf("Unable to parse Published time `%s` for %s with formats `%s`, using fetch time",
+			item.Published, item.Title, strings.Join(rssFeed.GetPublishFormats(), "`, `"))
+		t = fetched
+	}
+
+	// figure out torrent info
+	torrentUrl := ""
+	torrentLength := ""
+	for _, enclosure := range item.Enclosures {
+		if enclosure.Type == "application/x-bittorrent" {
+			torrentUrl = enclosure.URL
+			torrentLength = enclosure.Length
+			break
+		}
+	}
+
+	// torrent extension fields
+	torrentCategories := []string{}
+	torrentSize := ""
+	for _, val1 := range item.Extensions {
+		for _, val2 := range val1 {
+			for _, ext := range val2 {
+				switch name := ext.Attrs["name"]; name {
+				case "category":
+					torrentCategories = strings.Split(ext.Attrs["value"], ", ")
+				case "size":
+					torrentSize = ext.Attrs["value"]
 				}
-				break
 			}
 		}
+	}
 
-		// torrent extension fields
-		torrentCategories := []string{}
-		torrentSize := ""
-		for _, val1 := range item.Extensions {
-			for _, val2 := range val1 {
-				for _, ext := range val2 {
-					switch name := ext.Attrs["name"]; name {
-					case "category":
-						torrentCategories = strings.Split(ext.Attrs["value"], ", ")
-					case "size":
-						torrentSize = ext.Attrs["value"]
-					}
-				}
+	// prefer the enclosure length, but fall back to the human size
+	torrentBytes, err := strconv.ParseUint(torrentLength, 10, 64)
+	if err != nil || torrentBytes == 0 {
+		torrentBytes, err = ParseBytes(torrentSize)
+		if err != nil {
+			log.Warnf("Unable to determine size of %s from length `%s` or size `%s`",
+				item.Title, torrentLength, torrentSize)
+			torrentBytes = 0
+		}
+	}
+	if torrentBytes > 0 {
+		torrentSize = FormatBytes(torrentBytes)
+	}
+
+	entry = RssFeedEntry{
+		FeedName:          feedname,
+		Title:             item.Title,
+		Published:         t,
+		Categories:        item.Categories,
+		Description:       item.Description,
+		Url:               item.Link,
+		TorrentUrl:        torrentUrl,
+		TorrentBytes:      torrentBytes,
+		TorrentSize:       torrentSize,
+		TorrentCategories: torrentCategories,
+	}
+	return entry, dateOk, nil
+}
+
+// Returns the time the item was published.  Our configured formats are tried
+// first since they know the feed's timezone, then whatever gofeed figured out
+// from the Published & Updated fields.  Returns false if nothing worked.
+func ParsePublished(rssFeed RssFeed, item *gofeed.Item) (time.Time, bool) {
+	for _, value := range []string{item.Published, item.Updated} {
+		if value == "" {
+			continue
+		}
+		for _, format := range rssFeed.GetPublishFormats() {
+			if t, err := time.ParseInLocation(format, value, rssFeed.GetLocation()); err == nil {
+				return t, true
 			}
 		}
-		ret = append(ret,
-			RssFeedEntry{
-				FeedName:          feedname,
-				Title:             item.Title,
-				Published:         t,
-				Categories:        item.Categories,
-				Description:       item.Description,
-				Url:               item.Link,
-				TorrentUrl:        torrentUrl,
-				TorrentBytes:      torrentBytes,
-				TorrentSize:       torrentSize,
-				TorrentCategories: torrentCategories,
-			})
 	}
-	return ret, nil
+
+	if item.PublishedParsed != nil {
+		return *item.PublishedParsed, true
+	}
+	if item.UpdatedParsed != nil {
+		return *item.UpdatedParsed, true
+	}
+	return time.Time{}, false
 }
 
 // filters the given entries and returns those that match our filters
@@ -246,6 +589,7 @@ func FilterEntries(entries []RssFeedEntry, feed RssFeed, filters []string) ([]Rs
 					// set if this entry should be auto downloaded
 					filters := feed.GetFilters()
 					entry.AutoDownload = filters[filter].AutoDownload
+					entry.Filter = filter
 					retEntries = append(retEntries, entry)
 				}
 			}
@@ -254,6 +598,19 @@ func FilterEntries(entries []RssFeedEntry, feed RssFeed, filters []string) ([]Rs
 	return retEntries, nil
 }
 
+// matches the series name before the SxxEyy or 1x02 episode number
+var SERIES_RE = regexp.MustCompile(`^(.+?)[ ._-]+(?i:s\d+e\d+|\d+x\d+)`)
+
+// Returns the series name for a title or directory name, or "" if it isn't
+// an episode of a series
+func SeriesName(title string) string {
+	match := SERIES_RE.FindStringSubmatch(title)
+	if match == nil {
+		return ""
+	}
+	return strings.TrimSpace(strings.NewReplacer(".", " ", "_", " ").Replace(match[1]))
+}
+
 // returns true or false if the entry is already in the entries
 func RssFeedEntryExits(entries []RssFeedEntry, entry RssFeedEntry) bool {
 	for _, e := range entries {
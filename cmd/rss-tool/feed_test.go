@@ -0,0 +1,191 @@
+package main
+
+/*
+ * RSS Download Tool
+ * Copyright (c) 2021 Aaron Turner  <aturner at synfin dot net>
+ *
+ * This program is free software: you can redistribute it
+ * and/or modify it under the terms of the GNU General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or with the authors permission any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mmcdole/gofeed"
+)
+
+func TestFeedConfigExtends(t *testing.T) {
+	konf := testKonf(t, map[string]interface{}{
+		"Templates.base.FeedType":     "RFM",
+		"Templates.base.DownloadPath": "/downloads",
+		"Templates.base.Order":        5,
+		"Templates.hd.Extends":        "base",
+		"Templates.hd.MinSize":        "1GB",
+		"Templates.hd.Order":          10,
+		"Feeds.tv.Extends":            "hd",
+		"Feeds.tv.BaseUrl":            "http://example.com/rss",
+		"Feeds.tv.Order":              1,
+	})
+	feedKonf, err := feedConfig(konf, "Feeds.tv")
+	if err != nil {
+		t.Fatalf("feedConfig returned error: %s", err)
+	}
+	expected := map[string]string{
+		"FeedType":     "RFM",
+		"DownloadPath": "/downloads",
+		"MinSize":      "1GB",
+		"BaseUrl":      "http://example.com/rss",
+		"Order":        "1",
+	}
+	for key, value := range expected {
+		if got := feedKonf.String(key); got != value {
+			t.Errorf("%s = %q, expected %q", key, got, value)
+		}
+	}
+	if feedKonf.Exists(EXTENDS) {
+		t.Errorf("%s wasn't removed", EXTENDS)
+	}
+}
+
+func TestFeedConfigErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		values map[string]interface{}
+		err    string
+	}{
+		{
+			"self loop",
+			map[string]interface{}{
+				"Templates.a.Extends": "a",
+				"Feeds.tv.Extends":    "a",
+			},
+			"Template loop: a => a",
+		},
+		{
+			"loop",
+			map[string]interface{}{
+				"Templates.a.Extends": "b",
+				"Templates.b.Extends": "a",
+				"Feeds.tv.Extends":    "a",
+			},
+			"Template loop: a => b => a",
+		},
+		{
+			"unknown",
+			map[string]interface{}{
+				"Templates.a.Extends": "missing",
+				"Feeds.tv.Extends":    "a",
+			},
+			"Unknown template: missing",
+		},
+	}
+
+	for _, test := range tests {
+		_, err := feedConfig(testKonf(t, test.values), "Feeds.tv")
+		if err == nil {
+			t.Errorf("%s: expected an error", test.name)
+		} else if !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s: error = %q, expected %q", test.name, err, test.err)
+		}
+	}
+}
+
+func TestParsePublished(t *testing.T) {
+	parsed := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	ny, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skipf("No timezone data: %s", err)
+	}
+
+	tests := []struct {
+		name     string
+		feed     *RfmFeed
+		item     gofeed.Item
+		expected time.Time
+		ok       bool
+	}{
+		{
+			"default format",
+			&RfmFeed{},
+			gofeed.Item{Published: "2021-05-02 03:04:05"},
+			time.Date(2021, 5, 2, 3, 4, 5, 0, time.UTC),
+			true,
+		},
+		{
+			"feed timezone",
+			&RfmFeed{Timezone: "America/New_York"},
+			gofeed.Item{Published: "2021-05-02 03:04:05"},
+			time.Date(2021, 5, 2, 3, 4, 5, 0, ny),
+			true,
+		},
+		{
+			"second format",
+			&RfmFeed{PublishFormats: []string{RFM_PUBLISH_FORMAT, "02 Jan 2006 15:04"}},
+			gofeed.Item{Published: "02 May 2021 03:04"},
+			time.Date(2021, 5, 2, 3, 4, 0, 0, time.UTC),
+			true,
+		},
+		{
+			"configured formats beat gofeed",
+			&RfmFeed{},
+			gofeed.Item{Published: "2021-05-02 03:04:05", PublishedParsed: &parsed},
+			time.Date(2021, 5, 2, 3, 4, 5, 0, time.UTC),
+			true,
+		},
+		{
+			"Updated",
+			&RfmFeed{},
+			gofeed.Item{Published: "garbage", Updated: "2021-05-02 03:04:05"},
+			time.Date(2021, 5, 2, 3, 4, 5, 0, time.UTC),
+			true,
+		},
+		{
+			"gofeed Published",
+			&RfmFeed{},
+			gofeed.Item{Published: "Tue, 01 Jun 2021 12:00:00 GMT", PublishedParsed: &parsed},
+			parsed,
+			true,
+		},
+		{
+			"gofeed Updated",
+			&RfmFeed{},
+			gofeed.Item{Updated: "2021-06-01T12:00:00Z", UpdatedParsed: &parsed},
+			parsed,
+			true,
+		},
+		{
+			"unparsable",
+			&RfmFeed{},
+			gofeed.Item{Published: "yesterday"},
+			time.Time{},
+			false,
+		},
+		{
+			"missing",
+			&RfmFeed{},
+			gofeed.Item{},
+			time.Time{},
+			false,
+		},
+	}
+
+	for _, test := range tests {
+		published, ok := ParsePublished(test.feed, &test.item)
+		if ok != test.ok || !published.Equal(test.expected) {
+			t.Errorf("%s: ParsePublished() = %s, %t, expected %s, %t",
+				test.name, published, ok, test.expected, test.ok)
+		}
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+/*
+ * RSS Download Tool
+ * Copyright (c) 2021 Aaron Turner  <aturner at synfin dot net>
+ *
+ * This program is free software: you can redistribute it
+ * and/or modify it under the terms of the GNU General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or with the authors permission any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	DEFAULT_FILENAME_TEMPLATE = "{{.Title}}.torrent"
+	MAX_FILENAME_LEN          = 200 // bytes per path component
+	MAX_FILENAME_COLLISIONS   = 100
+)
+
+// Returns the path under basePath for the entry using the given template.
+// Only the template can create sub directories, path separators in the
+// entry are replaced.  Each path component is sanitised so the result is
+// always inside basePath.
+func RenderFilename(basePath, tmpl string, entry RssFeedEntry) (string, error) {
+	if tmpl == "" {
+		tmpl = DEFAULT_FILENAME_TEMPLATE
+	}
+	t, err := template.New("filename").Option("missingkey=error").Parse(tmpl)
+	if err != nil {
+		return "", fmt.Errorf("Invalid FilenameTemplate: %s", err)
+	}
+	buf := bytes.Buffer{}
+	if err = t.Execute(&buf, pathSafeEntry(entry)); err != nil {
+		return "", fmt.Errorf("Invalid FilenameTemplate: %s", err)
+	}
+
+	parts := []string{}
+	for _, part := range strings.Split(filepath.ToSlash(buf.String()), "/") {
+		if part = SanitizeFilename(part); part != "" {
+			parts = append(parts, part)
+		}
+	}
+	if len(parts) == 0 {
+		return "", fmt.Errorf("FilenameTemplate generated an empty filename for %s", entry.Title)
+	}
+
+	path := filepath.Join(append([]string{basePath}, parts...)...)
+	if !isSubPath(basePath, path) {
+		return "", fmt.Errorf("Invalid filename %s for %s", path, entry.Title)
+	}
+	return path, nil
+}
+
+// Returns a copy of the entry without path separators in the fields which
+// are likely to be used in a FilenameTemplate
+func pathSafeEntry(entry RssFeedEntry) RssFeedEntry {
+	r := strings.NewReplacer("/", "_", "\\", "_")
+	entry.FeedName = r.Replace(entry.FeedName)
+	entry.Title = r.Replace(entry.Title)
+	entry.Filter = r.Replace(entry.Filter)
+	entry.TorrentSize = r.Replace(entry.TorrentSize)
+	categories := []string{}
+	for _, c := range entry.Categories {
+		categories = append(categories, r.Replace(c))
+	}
+	entry.Categories = categories
+	return entry
+}
+
+// Makes a single path component safe to use as a filename
+func SanitizeFilename(name string) string {
+	name = strings.Map(func(r rune) rune {
+		switch {
+		case strings.ContainsRune(`/\:*?"<>|`, r):
+			return '_'
+		case unicode.IsControl(r):
+			return -1
+		}
+		return r
+	}, name)
+	// no hidden files, `.` or `..`
+	name = strings.Trim(name, " .")
+	return truncateFilename(name, MAX_FILENAME_LEN)
+}
+
+// Truncates the filename to max bytes, keeping the extension and not
+// splitting any UTF-8 characters
+func truncateFilename(name string, max int) string {
+	if len(name) <= max {
+		return name
+	}
+	ext := filepath.Ext(name)
+	if len(ext) > max/2 {
+		ext = ""
+	}
+	base := name[:max-len(ext)]
+	for len(base) > 0 && !utf8.ValidString(base) {
+		base = base[:len(base)-1]
+	}
+	return strings.TrimRight(base, " .") + ext
+}
+
+// Returns path or, if it already exists, the first unused `name-N.ext`
+func uniqueFilename(path string) (string, error) {
+	ext := filepath.Ext(path)
+	base := strings.TrimSuffix(path, ext)
+	for i := 0; i < MAX_FILENAME_COLLISIONS; i++ {
+		name := path
+		if i > 0 {
+			name = fmt.Sprintf("%s-%d%s", base, i, ext)
+		}
+		if _, err := os.Lstat(name); os.IsNotExist(err) {
+			return name, nil
+		} else if err != nil {
+			return "", err
+		}
+	}
+	return "", fmt.Errorf("Too many files named like %s", path)
+}
+
+// Writes data to a new file at path, creating any missing directories.
+// The data is written to a hidden temp file which is renamed into place
+// so nothing watching the directory sees a partial file.  Returns the
+// path written which may differ from path if it already existed.
+func WriteFileAtomic(path string, data []byte, perm os.FileMode) (string, error) {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+
+	tmp, err := ioutil.TempFile(dir, "."+filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name()) // no-op after the rename
+
+	if _, err = tmp.Write(data); err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", err
+	}
+	if err = os.Chmod(tmp.Name(), perm); err != nil {
+		return "", err
+	}
+
+	if path, err = uniqueFilename(path); err != nil {
+		return "", err
+	}
+	return path, os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,196 @@
+package main
+
+/*
+ * RSS Download Tool
+ * Copyright (c) 2021 Aaron Turner  <aturner at synfin dot net>
+ *
+ * This program is free software: you can redistribute it
+ * and/or modify it under the terms of the GNU General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or with the authors permission any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestSanitizeFilename(t *testing.T) {
+	tests := []struct {
+		name     string
+		expected string
+	}{
+		{"Show.Name.S01E01.1080p", "Show.Name.S01E01.1080p"},
+		{"", ""},
+		{".", ""},
+		{"..", ""},
+		{"...", ""},
+		{" .. ", ""},
+		{".hidden", "hidden"},
+		{"trailing. ", "trailing"},
+		{"a/b", "a_b"},
+		{`a\b`, "a_b"},
+		{"../../etc/passwd", "_.._etc_passwd"},
+		{`C:\Windows`, "C__Windows"},
+		{`what?*"<>|`, "what______"},
+		{"tab\there\nnewline\x00nul", "tabherenewlinenul"},
+		{"Amélie (2001) 日本語", "Amélie (2001) 日本語"},
+	}
+
+	for _, test := range tests {
+		if name := SanitizeFilename(test.name); name != test.expected {
+			t.Errorf("SanitizeFilename(%q) = %q, expected %q", test.name, name, test.expected)
+		}
+	}
+}
+
+func TestSanitizeFilenameLength(t *testing.T) {
+	tests := []struct {
+		name     string
+		expected string
+	}{
+		{strings.Repeat("a", MAX_FILENAME_LEN), strings.Repeat("a", MAX_FILENAME_LEN)},
+		{strings.Repeat("a", MAX_FILENAME_LEN+1), strings.Repeat("a", MAX_FILENAME_LEN)},
+		// the extension is kept
+		{strings.Repeat("a", 300) + ".torrent", strings.Repeat("a", MAX_FILENAME_LEN-8) + ".torrent"},
+		// a huge "extension" isn't
+		{"a." + strings.Repeat("b", 300), "a." + strings.Repeat("b", MAX_FILENAME_LEN-2)},
+		// multi-byte characters aren't split
+		{strings.Repeat("日", 100) + ".torrent", strings.Repeat("日", 64) + ".torrent"},
+		{"a" + strings.Repeat("é", 150), "a" + strings.Repeat("é", 99)},
+		// no trailing dots or spaces after truncating
+		{strings.Repeat("a", MAX_FILENAME_LEN-1) + " bbbb", strings.Repeat("a", MAX_FILENAME_LEN-1)},
+	}
+
+	for _, test := range tests {
+		name := SanitizeFilename(test.name)
+		if name != test.expected {
+			t.Errorf("SanitizeFilename(%d bytes) = %q, expected %q", len(test.name), name, test.expected)
+		}
+		if len(name) > MAX_FILENAME_LEN {
+			t.Errorf("SanitizeFilename(%d bytes) is %d bytes", len(test.name), len(name))
+		}
+		if !utf8.ValidString(name) {
+			t.Errorf("SanitizeFilename(%d bytes) is not valid UTF-8", len(test.name))
+		}
+	}
+}
+
+func TestRenderFilename(t *testing.T) {
+	base := "/downloads"
+	entry := RssFeedEntry{
+		FeedName:    "tv",
+		Title:       "Show.Name.S01E01.1080p",
+		Categories:  []string{"TV", "HD"},
+		Filter:      "shows",
+		TorrentSize: "1.37 GB",
+	}
+	tests := []struct {
+		tmpl     string
+		title    string // overrides entry.Title
+		expected string
+		err      bool
+	}{
+		{"", "", "/downloads/Show.Name.S01E01.1080p.torrent", false},
+		{"{{.FeedName}}/{{.Filter}}/{{.Title}}.torrent", "", "/downloads/tv/shows/Show.Name.S01E01.1080p.torrent", false},
+		{"{{.Series}}/{{.Title}}.torrent", "", "/downloads/Show Name/Show.Name.S01E01.1080p.torrent", false},
+
+		// the entry can't create directories or escape basePath
+		{"", "../../etc/passwd", "/downloads/_.._etc_passwd.torrent", false},
+		{"", "..", "/downloads/torrent", false},
+		{"{{.Title}}/x.torrent", "..", "/downloads/x.torrent", false},
+		{"", `a\b/c`, "/downloads/a_b_c.torrent", false},
+		{"{{.Title}}", "/", "/downloads/_", false},
+
+		// nor can the template
+		{"../../{{.Title}}.torrent", "", "/downloads/Show.Name.S01E01.1080p.torrent", false},
+		{"/etc/{{.Title}}", "", "/downloads/etc/Show.Name.S01E01.1080p", false},
+		{"./{{.FeedName}}//{{.Title}}", "", "/downloads/tv/Show.Name.S01E01.1080p", false},
+		{"x:/{{.Title}}", "", "/downloads/x_/Show.Name.S01E01.1080p", false},
+
+		// errors
+		{"{{.Title}", "", "", true},
+		{"{{.Missing}}", "", "", true},
+		{"../..", "", "", true},
+		{"{{.Title}}", "..", "", true},
+	}
+
+	for _, test := range tests {
+		e := entry
+		if test.title != "" {
+			e.Title = test.title
+		}
+		path, err := RenderFilename(base, test.tmpl, e)
+		if test.err {
+			if err == nil {
+				t.Errorf("RenderFilename(%q, %q) = %q, expected an error", test.tmpl, e.Title, path)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("RenderFilename(%q, %q) returned error: %s", test.tmpl, e.Title, err)
+		} else if path != test.expected {
+			t.Errorf("RenderFilename(%q, %q) = %q, expected %q", test.tmpl, e.Title, path, test.expected)
+		}
+	}
+}
+
+func TestWriteFileAtomicCollisions(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "sub", "Show.torrent")
+	expected := []string{
+		filepath.Join(dir, "sub", "Show.torrent"),
+		filepath.Join(dir, "sub", "Show-1.torrent"),
+		filepath.Join(dir, "sub", "Show-2.torrent"),
+	}
+	for i, want := range expected {
+		got, err := WriteFileAtomic(path, []byte{byte(i)}, 0644)
+		if err != nil {
+			t.Fatalf("WriteFileAtomic returned error: %s", err)
+		}
+		if got != want {
+			t.Errorf("WriteFileAtomic #%d wrote %s, expected %s", i, got, want)
+		}
+		data, err := ioutil.ReadFile(got)
+		if err != nil || len(data) != 1 || data[0] != byte(i) {
+			t.Errorf("%s has %v, expected [%d]", got, data, i)
+		}
+	}
+
+	// no temp files are left behind
+	files, err := ioutil.ReadDir(filepath.Join(dir, "sub"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != len(expected) {
+		t.Errorf("Expected %d files, found %d", len(expected), len(files))
+	}
+}
+
+func TestUniqueFilenameLimit(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "Show.torrent")
+	for i := 0; i < MAX_FILENAME_COLLISIONS; i++ {
+		name, err := uniqueFilename(path)
+		if err != nil {
+			t.Fatalf("uniqueFilename returned error after %d files: %s", i, err)
+		}
+		if err = ioutil.WriteFile(name, []byte{}, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if name, err := uniqueFilename(path); err == nil {
+		t.Errorf("uniqueFilename = %s, expected an error after %d files", name, MAX_FILENAME_COLLISIONS)
+	}
+}
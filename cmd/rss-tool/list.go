@@ -19,13 +19,15 @@ package main
  */
 
 import (
-	"fmt"
-
-	log "github.com/sirupsen/logrus"
+	"os"
 )
 
 type ListCmd struct {
-	Feed string `kong:"arg,optional,help='Specify feed name to list entries'"`
+	Feed        string `kong:"arg,optional,help='Specify feed name to list entries'"`
+	Format      string `kong:"optional,name='format',short='f',default='text',enum='${OUTPUT_FORMATS}',help='Output format [${OUTPUT_FORMATS}]'"`
+	Template    string `kong:"optional,name='template',short='t',help='Go template for each entry with --format template'"`
+	MatchedOnly bool   `kong:"optional,name='matched-only',short='m',default=false,help='Only list entries matching a filter'"`
+	Input       string `kong:"optional,name='input',short='i',help='Read the feed from this file (- for stdin) instead of the network'"`
 }
 
 func (cmd *ListCmd) Run(ctx *RunContext) error {
@@ -38,40 +40,32 @@ func (cmd *ListCmd) Run(ctx *RunContext) error {
 
 // Just list the feed config
 func (cmd *ListCmd) ListAllFeeds(ctx *RunContext) error {
-	ctx.Konf.Print()
+	PrintConfig(ctx.Konf)
 	return nil
 }
 
 // List the contents of the given feed
 func (cmd *ListCmd) ListFeed(ctx *RunContext) error {
-	feedType := ctx.Konf.String(fmt.Sprintf("Feeds.%s.FeedType", ctx.Cli.List.Feed))
-	log.Debugf("FeedType: %s", feedType)
-
-	feed, ok := RSS_FEED_TYPES[feedType]
-	if !ok {
-		return fmt.Errorf("Unknown feed type: %s", feedType)
-	}
-	feed.Reset()
-
-	feedPath := fmt.Sprintf("Feeds.%s", ctx.Cli.List.Feed)
-	err := ctx.Konf.Unmarshal(feedPath, feed)
+	feed, err := LoadFeed(ctx.Konf, ctx.Cli.List.Feed)
 	if err != nil {
 		return err
 	}
-	log.Debugf("Feed: %v", feed)
 
-	entries, err := DownloadFeed(ctx.Cli.List.Feed, RssFeed(feed))
+	entries, err := DownloadFeed(ctx.Konf, ctx.Cli.List.Feed, feed, ctx.Cli.List.Input)
 	if err != nil {
 		return err
 	}
 
-	total := len(entries)
-	for i, entry := range entries {
-		fmt.Printf("%d %s", i, entry.Sprint())
-		if i+1 < total {
-			fmt.Printf("\n")
+	if ctx.Cli.List.MatchedOnly {
+		matched := []RssFeedEntry{}
+		for _, entry := range entries {
+			if match, filter := feed.Match(entry); match {
+				entry.Filter = filter
+				matched = append(matched, entry)
+			}
 		}
+		entries = matched
 	}
 
-	return nil
+	return WriteEntries(os.Stdout, ctx.Cli.List.Format, ctx.Cli.List.Template, entries)
 }
@@ -25,8 +25,6 @@ import (
 
 	"github.com/alecthomas/kong"
 	"github.com/knadh/koanf"
-	"github.com/knadh/koanf/parsers/yaml"
-	"github.com/knadh/koanf/providers/file"
 	"github.com/mattn/go-colorable"
 	log "github.com/sirupsen/logrus"
 )
@@ -54,20 +52,28 @@ type CLI struct {
 	Lines    bool   `kong:"optional,name='lines',default=false,help='Include line numbers in logs'"`
 	Log      string `kong:"optional,name='log',default='stderr',help='Output log file'"`
 	Config   string `kong:"optional,name='config',default='${CONFIG_FILE}',help='Config file'"`
+	Metrics  string `kong:"optional,name='metrics',default='',help='Write Prometheus metrics to this file'"`
 
 	// sub commands
-	Version  VersionCmd  `kong:"cmd,help='Print version and exit'"`
-	Download DownloadCmd `kong:"cmd,help='Download the feeds'"`
-	List     ListCmd     `kong:"cmd,help='List the configured feeds'"`
-	Push     PushCmd     `kong:"cmd,help='Send push notifications for new entries'"`
-	Skip     SkipCmd     `kong:"cmd,help='Check feed data and skip entries'"`
+	Version    VersionCmd    `kong:"cmd,help='Print version and exit'"`
+	ConfigCmd  ConfigCmd     `kong:"cmd,name='config',help='Validate or show the config'"`
+	Daemon     DaemonCmd     `kong:"cmd,help='Run continuously, checking feeds and reloading the config on change'"`
+	Download   DownloadCmd   `kong:"cmd,help='Download the feeds'"`
+	Errors     ErrorsCmd     `kong:"cmd,help='Show or clear the errors for entries in the cache'"`
+	List       ListCmd       `kong:"cmd,help='List the configured feeds'"`
+	Push       PushCmd       `kong:"cmd,help='Send push notifications for new entries'"`
+	Report     ReportCmd     `kong:"cmd,help='Email the activity report now'"`
+	Skip       SkipCmd       `kong:"cmd,help='Check feed data and skip entries'"`
+	Cleanup    CleanupCmd    `kong:"cmd,help='Remove old downloads using the Retention policies'"`
+	TestFilter TestFilterCmd `kong:"cmd,name='test-filter',help='Test the feed filters against a saved feed'"`
 }
 
 func main() {
 	d := kong.Description("RSS Download Manager")
 	vars := kong.Vars{
-		"CONFIG_FILE": CONFIG_FILE,
-		"CACHE_FILE":  CACHE_FILE,
+		"CONFIG_FILE":    CONFIG_FILE,
+		"CACHE_FILE":     CACHE_FILE,
+		"OUTPUT_FORMATS": OUTPUT_FORMATS,
 	}
 	cli := CLI{}
 	ctx := kong.Parse(&cli, d, vars)
@@ -98,18 +104,24 @@ func main() {
 		log.SetOutput(file)
 	}
 
+	config := GetPath(cli.Config)
+	konf, err := LoadConfig(config)
+	if err != nil {
+		log.WithError(err).Fatalf("Unable to open config file: %s", config)
+	}
+
 	run_ctx := RunContext{
 		Ctx:  ctx,
 		Cli:  &cli,
-		Konf: koanf.New("."),
+		Konf: konf,
 	}
 
-	config := GetPath(cli.Config)
-	if err := run_ctx.Konf.Load(file.Provider(config), yaml.Parser()); err != nil {
-		log.WithError(err).Fatalf("Unable to open config file: %s", config)
+	err = ctx.Run(&run_ctx)
+	if cli.Metrics != "" {
+		if merr := METRICS.Write(GetPath(cli.Metrics)); merr != nil {
+			log.WithError(merr).Errorf("Unable to write metrics: %s", cli.Metrics)
+		}
 	}
-
-	err := ctx.Run(&run_ctx)
 	if err != nil {
 		log.Fatalf("Error running command: %s", err.Error())
 	}
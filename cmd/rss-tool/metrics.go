@@ -0,0 +1,114 @@
+package main
+
+/*
+ * RSS Download Tool
+ * Copyright (c) 2021 Aaron Turner  <aturner at synfin dot net>
+ *
+ * This program is free software: you can redistribute it
+ * and/or modify it under the terms of the GNU General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or with the authors permission any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+const (
+	METRIC_FEED_ITEMS     = "rssdl_feed_items"
+	METRIC_FEED_BAD_DATES = "rssdl_feed_bad_dates"
+	METRIC_FEED_BAD_ITEMS = "rssdl_feed_bad_items"
+)
+
+// help text for each of our metrics
+var METRIC_HELP = map[string]string{
+	METRIC_FEED_ITEMS:     "Number of items read in the last fetch of the feed",
+	METRIC_FEED_BAD_DATES: "Number of items with an unparsable publish date in the last fetch",
+	METRIC_FEED_BAD_ITEMS: "Number of malformed items skipped in the last fetch",
+}
+
+// Per-feed gauges written in the Prometheus text format so they can
+// be picked up by the node_exporter textfile collector.  They hold the
+// values from the last fetch of each feed, so they mean the same thing
+// for one-shot runs and the daemon.
+type Metrics struct {
+	lock   sync.Mutex
+	gauges map[string]map[string]uint64 // metric => feed => value
+}
+
+var METRICS = &Metrics{
+	gauges: map[string]map[string]uint64{},
+}
+
+// Sets the given metric for the feed
+func (m *Metrics) Set(metric, feed string, value uint64) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if _, ok := m.gauges[metric]; !ok {
+		m.gauges[metric] = map[string]uint64{}
+	}
+	m.gauges[metric][feed] = value
+}
+
+// Returns the metrics in the Prometheus text format
+func (m *Metrics) Sprint() string {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	metrics := []string{}
+	for metric := range m.gauges {
+		metrics = append(metrics, metric)
+	}
+	sort.Strings(metrics)
+
+	b := bytes.Buffer{}
+	for _, metric := range metrics {
+		fmt.Fprintf(&b, "# HELP %s %s\n", metric, METRIC_HELP[metric])
+		fmt.Fprintf(&b, "# TYPE %s gauge\n", metric)
+		feeds := []string{}
+		for feed := range m.gauges[metric] {
+			feeds = append(feeds, feed)
+		}
+		sort.Strings(feeds)
+		for _, feed := range feeds {
+			fmt.Fprintf(&b, "%s{feed=%q} %d\n", metric, feed, m.gauges[metric][feed])
+		}
+	}
+	return b.String()
+}
+
+// Atomically writes the metrics to the given file
+func (m *Metrics) Write(path string) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".metrics-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err = tmp.WriteString(m.Sprint()); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Chmod(0644); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,273 @@
+package main
+
+/*
+ * RSS Download Tool
+ * Copyright (c) 2021 Aaron Turner  <aturner at synfin dot net>
+ *
+ * This program is free software: you can redistribute it
+ * and/or modify it under the terms of the GNU General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or with the authors permission any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+	"text/template"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	OUTPUT_FORMATS = "text,table,json,jsonl,csv,yaml,template"
+)
+
+var CSV_HEADER = []string{
+	"FeedName", "Title", "Published", "Categories", "Description", "Url",
+	"TorrentUrl", "TorrentBytes", "TorrentSize", "TorrentCategories",
+	"AutoDownload", "Filter",
+}
+
+// Returns the file extension to use for the given output format
+func FormatExtension(format string) string {
+	switch format {
+	case "text", "table", "template":
+		return "txt"
+	default:
+		return format
+	}
+}
+
+// Writes the entries to w in the given format.  tmpl is only used by
+// the `template` format and is executed once per entry.
+func WriteEntries(w io.Writer, format, tmpl string, entries []RssFeedEntry) error {
+	switch format {
+	case "text":
+		for i, entry := range entries {
+			if i > 0 {
+				fmt.Fprintf(w, "\n")
+			}
+			fmt.Fprintf(w, "%d %s", i, entry.Sprint())
+		}
+
+	case "table":
+		tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+		fmt.Fprintf(tw, "#\tPUBLISHED\tTITLE\tSIZE\tCATEGORIES\tFILTER\n")
+		for i, entry := range entries {
+			fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\t%s\n", i,
+				entry.Published.Local().Format("2006-01-02 15:04"), entry.Title,
+				entry.TorrentSize, strings.Join(entry.Categories, ","), entry.Filter)
+		}
+		return tw.Flush()
+
+	case "json":
+		b, err := json.MarshalIndent(entries, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(w, "%s\n", b)
+		return err
+
+	case "jsonl":
+		enc := json.NewEncoder(w)
+		for _, entry := range entries {
+			if err := enc.Encode(entry); err != nil {
+				return err
+			}
+		}
+
+	case "csv":
+		cw := csv.NewWriter(w)
+		if err := cw.Write(CSV_HEADER); err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			err := cw.Write([]string{
+				entry.FeedName,
+				entry.Title,
+				entry.Published.Format(time.RFC3339),
+				strings.Join(entry.Categories, ","),
+				entry.Description,
+				entry.Url,
+				entry.TorrentUrl,
+				fmt.Sprintf("%d", entry.TorrentBytes),
+				entry.TorrentSize,
+				strings.Join(entry.TorrentCategories, ","),
+				fmt.Sprintf("%t", entry.AutoDownload),
+				entry.Filter,
+			})
+			if err != nil {
+				return err
+			}
+		}
+		cw.Flush()
+		return cw.Error()
+
+	case "yaml":
+		enc := yaml.NewEncoder(w)
+		enc.SetIndent(2)
+		if err := enc.Encode(entries); err != nil {
+			return err
+		}
+		return enc.Close()
+
+	case "template":
+		if tmpl == "" {
+			return fmt.Errorf("--template is required with --format template")
+		}
+		t, err := template.New("entry").Parse(tmpl)
+		if err != nil {
+			return fmt.Errorf("Invalid template: %s", err)
+		}
+		for _, entry := range entries {
+			if err = t.Execute(w, entry); err != nil {
+				return err
+			}
+			if !strings.HasSuffix(tmpl, "\n") {
+				fmt.Fprintf(w, "\n")
+			}
+		}
+
+	default:
+		return fmt.Errorf("Unknown output format: %s", format)
+	}
+	return nil
+}
+
+var ERROR_CSV_HEADER = []string{
+	"Title", "Feed", "Count", "FirstSeen", "LastSeen", "HoldUntil", "Failed",
+	"Status", "Message",
+}
+
+// Writes the errors to w in the given format.  tmpl is only used by
+// the `template` format and is executed once per error.
+func WriteErrors(w io.Writer, format, tmpl string, records []ErrorEntry) error {
+	switch format {
+	case "text":
+		for i, e := range records {
+			if i > 0 {
+				fmt.Fprintf(w, "\n")
+			}
+			fmt.Fprintf(w, "%d %s\n\tFeed: %s\n\tCount: %d\n\tFirst Seen: %s\n\tLast Seen: %s\n\tStatus: %s\n\tMessage: %s\n",
+				i, e.Title, e.Feed, e.Count,
+				e.FirstSeen.Local().Format(ERROR_TIME_FORMAT),
+				e.LastSeen.Local().Format(ERROR_TIME_FORMAT), e.Status, e.Message)
+		}
+
+	case "table":
+		tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+		fmt.Fprintf(tw, "TITLE\tFEED\tCOUNT\tFIRST SEEN\tLAST SEEN\tSTATUS\tMESSAGE\n")
+		for _, e := range records {
+			fmt.Fprintf(tw, "%s\t%s\t%d\t%s\t%s\t%s\t%s\n", e.Title, e.Feed, e.Count,
+				e.FirstSeen.Local().Format(ERROR_TIME_FORMAT),
+				e.LastSeen.Local().Format(ERROR_TIME_FORMAT), e.Status, e.Message)
+		}
+		return tw.Flush()
+
+	case "json":
+		b, err := json.MarshalIndent(records, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(w, "%s\n", b)
+		return err
+
+	case "jsonl":
+		enc := json.NewEncoder(w)
+		for _, e := range records {
+			if err := enc.Encode(e); err != nil {
+				return err
+			}
+		}
+
+	case "csv":
+		cw := csv.NewWriter(w)
+		if err := cw.Write(ERROR_CSV_HEADER); err != nil {
+			return err
+		}
+		for _, e := range records {
+			err := cw.Write([]string{
+				e.Title,
+				e.Feed,
+				fmt.Sprintf("%d", e.Count),
+				e.FirstSeen.Format(time.RFC3339),
+				e.LastSeen.Format(time.RFC3339),
+				e.HoldUntil.Format(time.RFC3339),
+				fmt.Sprintf("%t", e.Failed),
+				e.Status,
+				e.Message,
+			})
+			if err != nil {
+				return err
+			}
+		}
+		cw.Flush()
+		return cw.Error()
+
+	case "yaml":
+		enc := yaml.NewEncoder(w)
+		enc.SetIndent(2)
+		if err := enc.Encode(records); err != nil {
+			return err
+		}
+		return enc.Close()
+
+	case "template":
+		if tmpl == "" {
+			return fmt.Errorf("--template is required with --format template")
+		}
+		t, err := template.New("error").Parse(tmpl)
+		if err != nil {
+			return fmt.Errorf("Invalid template: %s", err)
+		}
+		for _, e := range records {
+			if err = t.Execute(w, e); err != nil {
+				return err
+			}
+			if !strings.HasSuffix(tmpl, "\n") {
+				fmt.Fprintf(w, "\n")
+			}
+		}
+
+	default:
+		return fmt.Errorf("Unknown output format: %s", format)
+	}
+	return nil
+}
+
+// Reads entries previously written in json or jsonl format
+func ReadEntries(r io.Reader, format string) ([]RssFeedEntry, error) {
+	entries := []RssFeedEntry{}
+	switch format {
+	case "json":
+		err := json.NewDecoder(r).Decode(&entries)
+		return entries, err
+
+	case "jsonl":
+		dec := json.NewDecoder(r)
+		for {
+			entry := RssFeedEntry{}
+			err := dec.Decode(&entry)
+			if err == io.EOF {
+				return entries, nil
+			} else if err != nil {
+				return entries, err
+			}
+			entries = append(entries, entry)
+		}
+	}
+	return entries, fmt.Errorf("Unable to read entries in %s format", format)
+}
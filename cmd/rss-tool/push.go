@@ -19,9 +19,9 @@ package main
  */
 
 import (
+	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"net/http"
 
 	"github.com/knadh/koanf"
@@ -33,77 +33,51 @@ type PushCmd struct {
 	Filters []string `kong:"arg,optional,help='Specify optional filters to use (default all)'"`
 	Cache   string   `kong:"optional,name='cache',short='c',default='${CACHE_FILE}',help='Cache file'"`
 	DryRun  bool     `kong:"help='Do not notify or update cache'"`
+	Input   string   `kong:"optional,name='input',short='i',help='Read the feed from this file (- for stdin) instead of the network'"`
 }
 
 func (cmd *PushCmd) Run(ctx *RunContext) error {
-	allFeeds := ctx.Konf.MapKeys("Feeds")
-	feeds := []string{}
-
-	if ctx.Cli.Push.Feed != "" {
-		for _, feed := range allFeeds {
-			if feed == ctx.Cli.Push.Feed {
-				feeds = append(feeds, ctx.Cli.Push.Feed)
-				break
-			}
-		}
-		if len(feeds) == 0 {
-			return fmt.Errorf("Invalid feed name: %s", ctx.Cli.Push.Feed)
-		}
-	} else {
-		// add our feeds in the specified order
-		feedCnt := len(allFeeds)
-		for i := 1; i <= feedCnt; i++ {
-			for _, feed := range allFeeds {
-				order := ctx.Konf.Int(fmt.Sprintf("Feeds.%s.Order", feed))
-				if order == i {
-					feeds = append(feeds, feed)
-				}
-			}
-		}
+	if ctx.Cli.Push.Input != "" && ctx.Cli.Push.Feed == "" {
+		return fmt.Errorf("--input requires a feed name")
+	}
 
-		// look for any feeds which don't have an order
-		for _, feed := range allFeeds {
-			hasOrder := false
-			for _, x := range feeds {
-				if feed == x {
-					hasOrder = true
-					break
-				}
-			}
-			if !hasOrder {
-				feeds = append(feeds, feed)
-			}
-		}
+	feeds, err := SortedFeeds(ctx.Konf, ctx.Cli.Push.Feed)
+	if err != nil {
+		return err
 	}
 	log.Debugf("Feeds = %v", feeds)
 
-	for _, feed := range feeds {
-		err := push(ctx, feed)
-		if err != nil {
-			return err
-		}
+	cache, err := OpenCache(ctx.Cli.Push.Cache, CacheLockTimeout(ctx.Konf))
+	if err != nil {
+		return fmt.Errorf("Unable to open cache %s: %s", ctx.Cli.Push.Cache, err)
 	}
-	return nil
+	// deferred first, so the webhooks are sent after the cache is unlocked
+	defer SendPublished(ctx.Konf, cache)
+	defer cache.Close()
+
+	space := NewSpaceTracker(ctx.Konf)
+	err = processFeeds(ctx.Konf, cache, ctx.Cli.Push.DryRun, feeds, func(feedName string) error {
+		return push(ctx, cache, feedName, space)
+	})
+	if ctx.Cli.Push.DryRun {
+		return err
+	}
+	if digestErr := FlushQueued(ctx.Konf, cache); digestErr != nil {
+		log.WithError(digestErr).Errorf("Unable to send queued notifications")
+	}
+	if saveErr := cache.SaveCache(); saveErr != nil {
+		return saveErr
+	}
+	return err
 }
 
-func push(ctx *RunContext, feedName string) error {
+func push(ctx *RunContext, cache *CacheFile, feedName string, space *SpaceTracker) error {
 	log.Infof("Processing: %s", feedName)
 	// get our feed
-	feedType := ctx.Konf.String(fmt.Sprintf("Feeds.%s.FeedType", feedName))
-	if feedType == "" {
-		return fmt.Errorf("Missing FeedType for %s", feedName)
-	}
-	feed, ok := RSS_FEED_TYPES[feedType]
-	if !ok {
-		return fmt.Errorf("Unknown feed type: %s", feedType)
-	}
-	feed.Reset()
-
-	err := ctx.Konf.Unmarshal(fmt.Sprintf("Feeds.%s", feedName), feed)
+	feed, err := LoadFeed(ctx.Konf, feedName)
 	if err != nil {
 		return err
 	}
-	log.Debugf("Feed: %v", feed)
 
 	// which filters to enable
 	filters := []string{}
@@ -115,7 +89,7 @@ func push(ctx *RunContext, feedName string) error {
 		}
 	}
 
-	newEntries, err := DownloadFeed(feedName, RssFeed(feed))
+	newEntries, err := DownloadFeed(ctx.Konf, feedName, feed, ctx.Cli.Push.Input)
 	if err != nil {
 		return err
 	}
@@ -125,67 +99,148 @@ func push(ctx *RunContext, feedName string) error {
 		return err
 	}
 
-	// load our cache
-	cache, err := OpenCache(ctx.Cli.Push.Cache)
-	if err != nil {
-		log.WithError(err).Panicf("Unable to open cache: %s", ctx.Cli.Push.Cache)
+	// retry any downloads which were waiting for disk space
+	if !ctx.Cli.Push.DryRun {
+		for _, entry := range cache.Deferred {
+			if entry.FeedName != feedName {
+				continue
+			}
+			err = DownloadUrl(ctx.Konf, entry, feed, space)
+			if errors.Is(err, ErrNoSpace) {
+				log.Infof("Still deferred: %s", err)
+				continue
+			} else if err != nil && IsTransient(err) {
+				// keep it deferred so it isn't lost once it drops out of the feed
+				log.WithError(err).Warnf("Unable to download deferred %s, will retry", entry.Title)
+				continue
+			}
+			cache.RemoveDeferred(entry)
+			if err = handleDownloadResult(ctx, cache, feed, entry, true, err); err != nil {
+				return err
+			}
+		}
 	}
 
 	for _, entry := range filteredEntries {
-		if !RssFeedEntryExits(cache.Entries, entry) {
-			if ctx.Cli.Push.DryRun {
-				log.Infof("New entry: %s", entry.Title)
-				continue
-			} else {
-				log.Debugf("New entry: %s", entry.Title)
-			}
+		if RssFeedEntryExits(cache.Entries, entry) {
+			log.Debugf("Entry %s already exists in cache", entry.Title)
+			continue
+		} else if RssFeedEntryExits(cache.Deferred, entry) {
+			log.Debugf("Entry %s is waiting for disk space", entry.Title)
+			continue
+		} else if cache.HasFailed(entry.Title) {
+			log.Debugf("Entry %s has failed too many times", entry.Title)
+			continue
+		}
 
-			if feed.GetAutoDownload() || entry.AutoDownload {
-				err = DownloadUrl(ctx.Konf, entry, feed)
-			} else {
-				err = SendPush(ctx.Konf, entry, feed)
-			}
-			if err != nil {
-				log.WithError(err).Errorf("Unable to Download/Push notification for %s", entry.Title)
-				if cache.CheckNewError(entry.Title) {
-					if err = SendPushError(ctx.Konf, err); err != nil {
-						return err
-					}
-					cache.AddError(entry.Title)
-				}
-			} else {
-				cache.Entries = append(cache.Entries, entry)
+		if ctx.Cli.Push.DryRun {
+			log.Infof("New entry: %s", entry.Title)
+			continue
+		} else {
+			log.Debugf("New entry: %s", entry.Title)
+		}
+
+		download := feed.GetAutoDownload() || entry.AutoDownload
+		if download {
+			err = DownloadUrl(ctx.Konf, entry, feed, space)
+			if errors.Is(err, ErrNoSpace) {
+				log.Infof("Deferring download: %s", err)
+				cache.AddDeferred(entry)
+				PublishEvent(ctx.Konf, cache, NewEntryEvent(ctx.Konf, EVENT_MATCH, entry, nil))
+				continue
 			}
 		} else {
-			log.Debugf("Entry %s already exists in cache", entry.Title)
+			entry.Notified, err = NotifyEntry(ctx.Konf, cache, entry, feed)
+		}
+		if err == nil {
+			// failed entries are retried, so only publish the match once it's in the cache
+			PublishEvent(ctx.Konf, cache, NewEntryEvent(ctx.Konf, EVENT_MATCH, entry, nil))
+		}
+		if err = handleDownloadResult(ctx, cache, feed, entry, download, err); err != nil {
+			return err
 		}
 	}
-	return cache.SaveCache()
+	return nil
 }
 
-// Download an entry
-func DownloadUrl(konf *koanf.Koanf, entry RssFeedEntry, feed RssFeed) error {
-	disk, err := DiskUsage(konf, konf.String(DISK_PATH))
+// Records the result of downloading/notifying for an entry in the cache.
+// Download failures are only published when they are notified about.
+func handleDownloadResult(ctx *RunContext, cache *CacheFile, feed RssFeed, entry RssFeedEntry, download bool, err error) error {
+	if err == nil {
+		cache.Entries = append(cache.Entries, entry)
+		cache.ClearError(entry.Title)
+		if download {
+			PublishDownload(ctx.Konf, cache, entry, nil)
+		}
+		return nil
+	}
+
+	if IsTransient(err) {
+		// not in the cache, so we try again next time
+		log.WithError(err).Warnf("Unable to Download/Push notification for %s", entry.Title)
+		return nil
+	}
+
+	log.WithError(err).Errorf("Unable to Download/Push notification for %s", entry.Title)
+	if err = cache.RecordError(entry.FeedName, entry.Title, err, LoadErrorPolicy(ctx.Konf, feed)); err != nil {
+		if download {
+			PublishDownload(ctx.Konf, cache, entry, err)
+		}
+		return SendPushError(ctx.Konf, err)
+	}
+	return nil
+}
+
+// Download an entry to the download target picked by our placement policy
+func DownloadUrl(konf *koanf.Koanf, entry RssFeedEntry, feed RssFeed, space *SpaceTracker) error {
+	target, disk, err := SelectTarget(konf, entry, space)
 	if err != nil {
 		return err
 	}
-	if disk.Free < entry.TorrentBytes {
-		return fmt.Errorf("Not enough free space, unable to download %s", entry.Title)
+	if err = space.Reserve(target.DiskPath, disk, entry); err != nil {
+		return err
 	}
 
-	path := feed.DownloadFilename(feed.GetDownloadPath(), entry)
-	log.Debugf("Downloading %s", path)
-	resp, err := http.Get(entry.TorrentUrl)
+	if err = downloadTorrent(konf, entry, feed, target.GetDownloadPath(feed)); err != nil {
+		space.Release(target.DiskPath, entry)
+		return err
+	}
+	return nil
+}
+
+// Downloads the torrent file for the entry into downloadPath
+func downloadTorrent(konf *koanf.Koanf, entry RssFeedEntry, feed RssFeed, downloadPath string) error {
+	path, err := feed.DownloadFilename(downloadPath, entry)
 	if err != nil {
-		return fmt.Errorf("Unable to download %s: %s", entry.Title, err)
+		return err
 	}
-	torrent, err := io.ReadAll(resp.Body)
+	log.Debugf("Downloading %s", path)
+	retry := LoadRetryPolicy(konf)
+	client := retry.Client()
+	var torrent []byte
+	err = retry.Do(fmt.Sprintf("Downloading %s", entry.Title), func() error {
+		resp, err := client.Get(entry.TorrentUrl)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return HttpStatusError{
+				Url:        redactUrl(entry.TorrentUrl),
+				StatusCode: resp.StatusCode,
+				Status:     resp.Status,
+			}
+		}
+		torrent, err = io.ReadAll(resp.Body)
+		return err
+	})
 	if err != nil {
-		return fmt.Errorf("Unable to read: %s: %s", entry.Title, err)
+		return fmt.Errorf("Unable to download %s: %w", entry.Title, err)
 	}
-	err = ioutil.WriteFile(path, []byte(torrent), 0644)
+	path, err = WriteFileAtomic(path, torrent, 0644)
 	if err != nil {
 		return fmt.Errorf("Unable to write %s: %s", path, err)
 	}
+	log.Infof("Downloaded %s", path)
 	return nil
 }
@@ -19,7 +19,9 @@ package main
  */
 
 import (
+	"errors"
 	"fmt"
+	"strconv"
 	"strings"
 	"time"
 
@@ -29,42 +31,294 @@ import (
 )
 
 const (
-	PUSHOVER_USER_KEYS = "Pushover.Users"
-	PUSHOVER_DEVICES   = "Pushover.Devices"
-	PUSHOVER_APP_KEY   = "Pushover.AppToken"
-	PUSHOVER_PRIORITY  = pushover.PriorityNormal
-	DISK_PATH          = "DiskPath"
+	PUSHOVER_USER_KEYS    = "Pushover.Users"
+	PUSHOVER_DEVICES      = "Pushover.Devices"
+	PUSHOVER_APP_KEY      = "Pushover.AppToken"
+	PUSHOVER              = "Pushover"
+	PUSHOVER_MAX_PER_HOUR = "Pushover.MaxPerHour"
+	PUSHOVER_PRIORITY     = pushover.PriorityNormal
+	PUSHOVER_MIN_RETRY    = 30 * time.Second // limits for emergency priority
+	PUSHOVER_MAX_EXPIRE   = 3 * time.Hour
+	DISK_PATH             = "DiskPath"
 )
 
-func SendPush(konf *koanf.Koanf, entry RssFeedEntry, feed RssFeed) error {
-	appKey := konf.String(PUSHOVER_APP_KEY)
-	userKeys := konf.Strings(PUSHOVER_USER_KEYS)
-	diskPath := konf.String(DISK_PATH)
+var PUSHOVER_PRIORITIES = map[string]int{
+	"lowest":    pushover.PriorityLowest,
+	"low":       pushover.PriorityLow,
+	"normal":    pushover.PriorityNormal,
+	"high":      pushover.PriorityHigh,
+	"emergency": pushover.PriorityEmergency,
+}
 
-	// app and user keys are required
-	if appKey == "" {
-		return fmt.Errorf("Missing `%s` in config", PUSHOVER_APP_KEY)
+// Settings for new entry notifications.  Set globally in Pushover and
+// overridden by each feed and filter.
+type PushoverOptions struct {
+	Priority string        `koanf:"Priority"` // lowest, low, normal, high, emergency or -2 to 2
+	Sound    string        `koanf:"Sound"`
+	Users    []string      `koanf:"Users"`   // user or group keys
+	Devices  []string      `koanf:"Devices"` // default is all devices
+	Retry    time.Duration `koanf:"Retry"`   // how often to repeat emergency notifications
+	Expire   time.Duration `koanf:"Expire"`  // when to stop repeating emergency notifications
+	TTL      time.Duration `koanf:"TTL"`     // delete the notification from devices after this
+	Digest   *DigestPolicy `koanf:"Digest"`  // batch matches into a periodic summary
+
+	// hold non-urgent notifications during HH:MM-HH:MM and send them afterwards
+	QuietHours string `koanf:"QuietHours"`
+	Timezone   string `koanf:"Timezone"` // for QuietHours, default is local time
+}
+
+// Overrides our settings with any set in o
+func (po *PushoverOptions) merge(o *PushoverOptions) {
+	if o == nil {
+		return
 	}
-	if len(userKeys) == 0 {
-		return fmt.Errorf("Missing `%s` in config", PUSHOVER_USER_KEYS)
+	if o.Priority != "" {
+		po.Priority = o.Priority
 	}
-	diskInfo := ""
-	if diskPath != "" {
-		disk, err := DiskUsage(konf, diskPath)
+	if o.Sound != "" {
+		po.Sound = o.Sound
+	}
+	if users := splitStrings(o.Users); len(users) > 0 {
+		po.Users = users
+	}
+	if devices := splitStrings(o.Devices); len(devices) > 0 {
+		po.Devices = devices
+	}
+	if o.Retry > 0 {
+		po.Retry = o.Retry
+	}
+	if o.Expire > 0 {
+		po.Expire = o.Expire
+	}
+	if o.TTL > 0 {
+		po.TTL = o.TTL
+	}
+	if o.Digest != nil {
+		po.Digest = o.Digest
+	}
+	if o.QuietHours != "" {
+		po.QuietHours = o.QuietHours
+		po.Timezone = o.Timezone
+	}
+}
+
+// Returns the pushover priority
+func (po *PushoverOptions) GetPriority() (int, error) {
+	if po.Priority == "" {
+		return PUSHOVER_PRIORITY, nil
+	}
+	if p, ok := PUSHOVER_PRIORITIES[strings.ToLower(po.Priority)]; ok {
+		return p, nil
+	}
+	p, err := strconv.Atoi(po.Priority)
+	if err != nil || p < pushover.PriorityLowest || p > pushover.PriorityEmergency {
+		return 0, fmt.Errorf("Invalid Priority: %s", po.Priority)
+	}
+	return p, nil
+}
+
+// Returns the global notification settings
+func LoadPushover(konf *koanf.Koanf) (PushoverOptions, error) {
+	opts := PushoverOptions{
+		Sound:  pushover.SoundCosmic,
+		Retry:  60 * time.Second,
+		Expire: time.Hour,
+	}
+	global := PushoverOptions{}
+	if err := konf.Unmarshal(PUSHOVER, &global); err != nil {
+		return opts, fmt.Errorf("Invalid %s: %s", PUSHOVER, err)
+	}
+	opts.merge(&global)
+	return opts, nil
+}
+
+// Returns the notification settings for the entry
+func PushoverFor(konf *koanf.Koanf, feed RssFeed, entry RssFeedEntry) (PushoverOptions, error) {
+	opts, err := LoadPushover(konf)
+	if err != nil {
+		return opts, err
+	}
+	opts.merge(feed.GetPushover())
+	if filter, ok := feed.GetFilters()[entry.Filter]; ok {
+		opts.merge(filter.Pushover)
+	}
+	return opts, opts.Validate()
+}
+
+// Checks the priority, digest and the emergency priority retry/expire limits
+func (po *PushoverOptions) Validate() error {
+	priority, err := po.GetPriority()
+	if err != nil {
+		return err
+	}
+	if po.Digest.Enabled() {
+		if _, err := po.Digest.NextSend(time.Now()); err != nil {
+			return fmt.Errorf("Invalid %s: %s", DIGEST, err)
+		}
+	}
+	if _, err := quietUntil(po.QuietHours, po.Timezone, time.Now()); err != nil {
+		return err
+	}
+	if priority != pushover.PriorityEmergency {
+		return nil
+	}
+	if po.Retry < PUSHOVER_MIN_RETRY {
+		return fmt.Errorf("Retry must be at least %s for emergency priority", PUSHOVER_MIN_RETRY)
+	}
+	if po.Expire > PUSHOVER_MAX_EXPIRE {
+		return fmt.Errorf("Expire must be at most %s for emergency priority", PUSHOVER_MAX_EXPIRE)
+	}
+	return nil
+}
+
+// Returns if matches should be batched into a digest instead of sent now.
+// Emergency priority matches are never delayed.
+func (po *PushoverOptions) UseDigest() bool {
+	priority, _ := po.GetPriority()
+	return po.Digest.Enabled() && priority != pushover.PriorityEmergency
+}
+
+// Who to send a new entry notification to
+type pushRecipient struct {
+	Name       string // user name, empty for Pushover.Users
+	Key        string
+	Devices    []string
+	QuietUntil time.Time // zero unless in quiet hours
+	Limits     []rateLimit
+}
+
+// Returns the recipients for the entry.  If any Users are configured, only
+// the subscribers to the feed & filter are notified.
+func pushRecipients(konf *koanf.Koanf, entry RssFeedEntry, opts PushoverOptions) ([]pushRecipient, error) {
+	recipients := []pushRecipient{}
+	if len(konf.MapKeys(USERS)) == 0 {
+		for _, key := range opts.Users {
+			r, err := newPushRecipient(konf, opts, nil, key)
+			if err != nil {
+				return recipients, err
+			}
+			recipients = append(recipients, r)
+		}
+		if len(recipients) == 0 {
+			return recipients, fmt.Errorf("Missing `%s` in config", PUSHOVER_USER_KEYS)
+		}
+		return recipients, nil
+	}
+
+	users, err := Subscribers(konf, entry.FeedName, entry.Filter)
+	if err != nil {
+		return recipients, err
+	}
+	for i := range users {
+		if users[i].Pushover == "" {
+			// only uses email
+			continue
+		}
+		r, err := newPushRecipient(konf, opts, &users[i], users[i].Pushover)
 		if err != nil {
-			return err
+			return recipients, err
 		}
-		diskInfo = disk.DiskInfo(entry.TorrentBytes)
+		recipients = append(recipients, r)
+	}
+	return recipients, nil
+}
+
+// Returns the recipient for the user, or the Pushover.Users key if user is nil
+func newPushRecipient(konf *koanf.Koanf, opts PushoverOptions, user *User, key string) (pushRecipient, error) {
+	now := time.Now()
+	r := pushRecipient{
+		Key:     key,
+		Devices: opts.Devices,
+		Limits:  []rateLimit{{Key: PUSHOVER, Max: konf.Int(PUSHOVER_MAX_PER_HOUR)}},
+	}
+	until, err := quietUntil(opts.QuietHours, opts.Timezone, now)
+	if err != nil {
+		return r, fmt.Errorf("%s: %s", PUSHOVER, err)
+	}
+	r.QuietUntil = until
+	if user == nil {
+		return r, nil
 	}
 
-	// if device names are given, use that, otherwise send to all devices
-	deviceNamesList := konf.Strings(PUSHOVER_DEVICES)
-	deviceNames := ""
-	if len(deviceNamesList) > 0 {
-		deviceNames = strings.Join(deviceNamesList, ",")
+	r.Name = user.Name
+	if len(user.Devices) > 0 {
+		r.Devices = user.Devices
+	}
+	r.Limits = append(r.Limits, rateLimit{Key: USERS + "." + user.Name, Max: user.MaxPerHour})
+	until, err = quietUntil(user.QuietHours, user.Timezone, now)
+	if err != nil {
+		return r, fmt.Errorf("%s.%s: %s", USERS, user.Name, err)
+	}
+	if until.After(r.QuietUntil) {
+		r.QuietUntil = until
+	}
+	return r, nil
+}
+
+// Sends a notification about the new entry and returns the names of the
+// Users which were notified
+func SendPush(konf *koanf.Koanf, cache *CacheFile, entry RssFeedEntry, feed RssFeed) ([]string, error) {
+	notified := []string{}
+	appKey := konf.String(PUSHOVER_APP_KEY)
+	opts, err := PushoverFor(konf, feed, entry)
+	if err != nil {
+		return notified, err
 	}
 
+	// app and user keys are required
+	if appKey == "" {
+		return notified, fmt.Errorf("Missing `%s` in config", PUSHOVER_APP_KEY)
+	}
+	recipients, err := pushRecipients(konf, entry, opts)
+	if err != nil {
+		return notified, err
+	}
+	if len(recipients) == 0 {
+		log.Infof("No subscribers for %s", entry.Title)
+		return notified, nil
+	}
+
+	msgText := entryMessage(konf, entry, feed)
+	priority, _ := opts.GetPriority()
+
 	app := pushover.New(appKey)
+	msgTitle := entry.Title
+	for _, recipient := range recipients {
+		message := &pushover.Message{
+			HTML:        true,
+			Message:     msgText,
+			Title:       msgTitle,
+			Priority:    priority,
+			URL:         entry.TorrentUrl,
+			URLTitle:    entry.Title,
+			Timestamp:   time.Now().Unix(),
+			Retry:       opts.Retry,
+			Expire:      opts.Expire,
+			TTL:         opts.TTL,
+			CallbackURL: "", // never used
+			Sound:       opts.Sound,
+		}
+		if recipient.send(cache, app, message, []string{entry.Title}) && recipient.Name != "" {
+			notified = append(notified, recipient.Name)
+		}
+	}
+	return notified, nil
+}
+
+// Returns the HTML message about the new entry with the disk status of the
+// target it would be downloaded to
+func entryMessage(konf *koanf.Koanf, entry RssFeedEntry, feed RssFeed) string {
+	// disk info is optional, so any problem just leaves it out
+	diskInfo := ""
+	target, disk, err := SelectTarget(konf, entry, nil)
+	if err != nil && !errors.Is(err, ErrNoSpace) {
+		log.WithError(err).Warnf("Unable to get disk info for %s", entry.Title)
+	} else if target.DiskPath != "" {
+		diskInfo = disk.DiskInfo(entry.TorrentBytes)
+		if target.Name != "" {
+			diskInfo = fmt.Sprintf("%s: %s", target.Name, diskInfo)
+		}
+	}
 
 	msgText := fmt.Sprintf(`
 There is a new %s Torrent available!
@@ -81,40 +335,55 @@ Torrent Size: %s
 
 <a href="https://brix.int.synfin.net/transmission/web/">Brix Transmission</a>
 	`, entry.FeedName, entry.Title, entry.TorrentSize, diskInfo, feed.UrlRewriter(entry.Url))
+	return msgText
+}
 
-	msgTitle := entry.Title
-	message := pushover.Message{
-		HTML:        true,
-		Message:     msgText,
-		Title:       msgTitle,
-		Priority:    PUSHOVER_PRIORITY,
-		URL:         entry.TorrentUrl,
-		URLTitle:    entry.Title,
-		Timestamp:   time.Now().Unix(),
-		Retry:       60 * time.Second,
-		Expire:      time.Hour,
-		DeviceName:  deviceNames,
-		CallbackURL: "", // never used
-		Sound:       pushover.SoundCosmic,
+// Sends the message to the recipient on their devices or holds it in the
+// cache during quiet hours, when over a rate limit or if sending fails.
+// entries are the titles of the matches the message is about.  Returns
+// true only if the message was sent now.
+func (r pushRecipient) send(cache *CacheFile, app *pushover.Pushover, message *pushover.Message, entries []string) bool {
+	now := time.Now()
+	if until, reason := r.holdUntil(cache, message.Priority, now); until.After(now) {
+		cache.Hold(r, message, entries, until, reason)
+		return false
 	}
-	for _, user := range userKeys {
-		_, err := app.SendMessage(&message, pushover.NewRecipient(user))
-		if err != nil {
-			log.WithError(err).Errorf("Unable to send message to %s: %s", user, err)
-		}
+
+	if err := r.deliver(cache, app, message, now); err != nil {
+		log.WithError(err).Errorf("Unable to send message to %s, retrying in %s", r.displayName(), QUEUED_RETRY_DELAY)
+		cache.Hold(r, message, entries, now.Add(QUEUED_RETRY_DELAY), HOLD_SEND_FAILED)
+		return false
+	}
+	return true
+}
+
+// Sends the message to the recipient on their devices now
+func (r pushRecipient) deliver(cache *CacheFile, app *pushover.Pushover, message *pushover.Message, now time.Time) error {
+	message.DeviceName = strings.Join(r.Devices, ",") // empty is all devices
+	if _, err := app.SendMessage(message, pushover.NewRecipient(r.Key)); err != nil {
+		return err
 	}
+	cache.RecordSent(r.Limits, now)
 	return nil
 }
 
 func SendPushError(konf *koanf.Koanf, err error) error {
-	appKey := konf.String(PUSHOVER_APP_KEY)
-	userKeys := konf.Strings(PUSHOVER_USER_KEYS)
-
 	msgText := fmt.Sprintf(`
 Torrent Error:
 
 %s
 	`, err)
+	return sendPushText(konf, "RSS Feed Error", msgText, pushover.SoundSpaceAlarm)
+}
+
+// Sends a plain text notification
+func SendPushText(konf *koanf.Koanf, title, msgText string) error {
+	return sendPushText(konf, title, msgText, pushover.SoundPushover)
+}
+
+func sendPushText(konf *koanf.Koanf, title, msgText, sound string) error {
+	appKey := konf.String(PUSHOVER_APP_KEY)
+	userKeys := GetStrings(konf, PUSHOVER_USER_KEYS)
 
 	// app and user keys are required
 	if appKey == "" {
@@ -125,7 +394,7 @@ Torrent Error:
 	}
 
 	// if device names are given, use that, otherwise send to all devices
-	deviceNamesList := konf.Strings(PUSHOVER_DEVICES)
+	deviceNamesList := GetStrings(konf, PUSHOVER_DEVICES)
 	deviceNames := ""
 	if len(deviceNamesList) > 0 {
 		deviceNames = strings.Join(deviceNamesList, ",")
@@ -135,14 +404,14 @@ Torrent Error:
 	message := pushover.Message{
 		HTML:        false,
 		Message:     msgText,
-		Title:       "RSS Feed Error",
+		Title:       title,
 		Priority:    PUSHOVER_PRIORITY,
 		Timestamp:   time.Now().Unix(),
 		Retry:       60 * time.Second,
 		Expire:      time.Hour,
 		DeviceName:  deviceNames,
 		CallbackURL: "",
-		Sound:       pushover.SoundSpaceAlarm,
+		Sound:       sound,
 	}
 
 	for _, user := range userKeys {
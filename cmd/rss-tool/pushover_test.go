@@ -0,0 +1,174 @@
+package main
+
+/*
+ * RSS Download Tool
+ * Copyright (c) 2021 Aaron Turner  <aturner at synfin dot net>
+ *
+ * This program is free software: you can redistribute it
+ * and/or modify it under the terms of the GNU General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or with the authors permission any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gregdel/pushover"
+)
+
+const (
+	TEST_APP_TOKEN = "a00000000000000000000000000000"
+	TEST_USER_KEY  = "u00000000000000000000000000000"
+)
+
+// A stub of the Pushover API which fails while Fail is set
+type pushoverStub struct {
+	lock     sync.Mutex
+	fail     bool
+	messages []string // titles of the messages sent
+}
+
+func newPushoverStub(t *testing.T) *pushoverStub {
+	s := &pushoverStub{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		if s.fail {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		s.messages = append(s.messages, r.FormValue("title"))
+		w.Header().Set("X-Limit-App-Limit", "10000")
+		w.Header().Set("X-Limit-App-Remaining", "9999")
+		w.Header().Set("X-Limit-App-Reset", fmt.Sprintf("%d", time.Now().Add(time.Hour).Unix()))
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"status":1,"request":"test"}`)
+	}))
+	endpoint := pushover.APIEndpoint
+	pushover.APIEndpoint = server.URL
+	t.Cleanup(func() {
+		pushover.APIEndpoint = endpoint
+		server.Close()
+	})
+	return s
+}
+
+func (s *pushoverStub) Fail(fail bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.fail = fail
+}
+
+func (s *pushoverStub) Messages() []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]string{}, s.messages...)
+}
+
+// Returns an empty cache in a temporary directory
+func testCache(t *testing.T) *CacheFile {
+	cache, err := OpenCache(filepath.Join(t.TempDir(), "cache.json"), time.Second)
+	if err != nil {
+		t.Fatalf("Unable to open cache: %s", err)
+	}
+	t.Cleanup(func() { cache.Close() })
+	return cache
+}
+
+// Makes the held messages due and sends them
+func flushHeldNow(t *testing.T, konf map[string]interface{}, cache *CacheFile) {
+	for i := range cache.Held {
+		cache.Held[i].Until = time.Now().Add(-time.Second)
+	}
+	if err := FlushHeld(testKonf(t, konf), cache); err != nil {
+		t.Fatalf("FlushHeld returned error: %s", err)
+	}
+}
+
+func TestSendPushFailedIsHeld(t *testing.T) {
+	stub := newPushoverStub(t)
+	values := map[string]interface{}{
+		"Pushover.AppToken": TEST_APP_TOKEN,
+		"Pushover.Users":    []string{TEST_USER_KEY},
+	}
+	cache := testCache(t)
+	entry := RssFeedEntry{Title: "Show.Name.S01E01.1080p", FeedName: "tv", TorrentUrl: "http://example.com/1.torrent"}
+
+	stub.Fail(true)
+	start := time.Now()
+	if _, err := SendPush(testKonf(t, values), cache, entry, NewRfmFeed()); err != nil {
+		t.Fatalf("SendPush returned error: %s", err)
+	}
+	if len(cache.Held) != 1 {
+		t.Fatalf("Expected 1 held message, got %d", len(cache.Held))
+	}
+	held := cache.Held[0]
+	if held.Reason != HOLD_SEND_FAILED || held.Key != TEST_USER_KEY || held.Title != entry.Title {
+		t.Errorf("Unexpected held message: %+v", held)
+	}
+	if wait := held.Until.Sub(start); wait < QUEUED_RETRY_DELAY || wait > QUEUED_RETRY_DELAY+time.Minute {
+		t.Errorf("Held for %s, expected %s", wait, QUEUED_RETRY_DELAY)
+	}
+
+	stub.Fail(false)
+	flushHeldNow(t, values, cache)
+	if len(cache.Held) != 0 {
+		t.Errorf("Message is still held: %+v", cache.Held)
+	}
+	if sent := stub.Messages(); len(sent) != 1 || sent[0] != entry.Title {
+		t.Errorf("Sent %v, expected %s", sent, entry.Title)
+	}
+}
+
+func TestFlushDigestFailedIsHeld(t *testing.T) {
+	stub := newPushoverStub(t)
+	values := map[string]interface{}{
+		"Pushover.AppToken": TEST_APP_TOKEN,
+		"Pushover.Users":    []string{TEST_USER_KEY},
+	}
+	cache := testCache(t)
+	past := time.Now().Add(-time.Minute)
+	for _, title := range []string{"Show.Name.S01E01.1080p", "Show.Name.S01E02.1080p"} {
+		cache.Digest = append(cache.Digest, DigestEntry{
+			Entry: RssFeedEntry{Title: title, FeedName: "tv"},
+			Due:   past,
+		})
+	}
+
+	stub.Fail(true)
+	if err := FlushDigest(testKonf(t, values), cache); err != nil {
+		t.Fatalf("FlushDigest returned error: %s", err)
+	}
+	if len(cache.Digest) != 0 {
+		t.Errorf("Digest is still queued: %+v", cache.Digest)
+	}
+	if len(cache.Held) != 1 {
+		t.Fatalf("Expected the digest to be held, got %d held messages", len(cache.Held))
+	}
+	if held := cache.Held[0]; held.Reason != HOLD_SEND_FAILED || len(held.Entries) != 2 {
+		t.Errorf("Unexpected held message: %+v", held)
+	}
+
+	stub.Fail(false)
+	flushHeldNow(t, values, cache)
+	if len(cache.Held) != 0 {
+		t.Errorf("Digest is still held: %+v", cache.Held)
+	}
+	if sent := stub.Messages(); len(sent) != 1 || sent[0] != "2 new torrent(s)" {
+		t.Errorf("Sent %v, expected the digest", sent)
+	}
+}
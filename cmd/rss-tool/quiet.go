@@ -0,0 +1,322 @@
+package main
+
+/*
+ * RSS Download Tool
+ * Copyright (c) 2021 Aaron Turner  <aturner at synfin dot net>
+ *
+ * This program is free software: you can redistribute it
+ * and/or modify it under the terms of the GNU General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or with the authors permission any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+import (
+	"fmt"
+	"html"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gregdel/pushover"
+	"github.com/knadh/koanf"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	HOLD_QUIET_HOURS = "quiet hours"
+	HOLD_RATE_LIMIT  = "rate limit"
+	HOLD_SEND_FAILED = "send failed"
+)
+
+// Max number of notifications per hour for the given cache Sent key
+type rateLimit struct {
+	Key string
+	Max int // 0 is unlimited
+}
+
+// A notification waiting for quiet hours to end or a rate limit to reset
+type HeldMessage struct {
+	Name     string    `json:"Name"` // user name, empty for Pushover.Users
+	Key      string    `json:"Key"`
+	Title    string    `json:"Title"`
+	Message  string    `json:"Message"`
+	URL      string    `json:"URL"`
+	URLTitle string    `json:"URLTitle"`
+	Priority int       `json:"Priority"`
+	Sound    string    `json:"Sound"`
+	Entries  []string  `json:"Entries,omitempty"` // titles of the matches it is about
+	Reason   string    `json:"Reason"`
+	Held     time.Time `json:"Held"`
+	Until    time.Time `json:"Until"` // when to try sending it again
+}
+
+// Returns when the quiet hours which now is in end, or the zero time if
+// now is not in quiet hours
+func quietUntil(hours, timezone string, now time.Time) (time.Time, error) {
+	if hours == "" {
+		return time.Time{}, nil
+	}
+	start, end, err := parseQuietHours(hours)
+	if err != nil {
+		return time.Time{}, err
+	}
+	loc, err := time.LoadLocation(timezone)
+	if err != nil {
+		return time.Time{}, err
+	}
+	local := now.In(loc)
+	minute := local.Hour()*60 + local.Minute()
+	quiet := minute >= start && minute < end
+	if start > end {
+		// wraps around midnight
+		quiet = minute >= start || minute < end
+	}
+	if !quiet {
+		return time.Time{}, nil
+	}
+	day := local.Day()
+	if minute >= end {
+		day++
+	}
+	return time.Date(local.Year(), local.Month(), day, end/60, end%60, 0, 0, loc), nil
+}
+
+// Returns when a message with the given priority can be sent to the
+// recipient and why.  High priority messages ignore quiet hours and
+// emergency priority messages also ignore rate limits.
+func (r pushRecipient) holdUntil(cache *CacheFile, priority int, now time.Time) (time.Time, string) {
+	until, reason := time.Time{}, ""
+	if priority < pushover.PriorityHigh && r.QuietUntil.After(now) {
+		until, reason = r.QuietUntil, HOLD_QUIET_HOURS
+	}
+	if priority >= pushover.PriorityEmergency {
+		return until, reason
+	}
+	for _, limit := range r.Limits {
+		sent := cache.sentSince(limit.Key, now.Add(-time.Hour))
+		if limit.Max <= 0 || len(sent) < limit.Max {
+			continue
+		}
+		// can send again once the oldest message in the last hour expires
+		if reset := sent[len(sent)-limit.Max].Add(time.Hour); reset.After(until) {
+			until, reason = reset, HOLD_RATE_LIMIT
+		}
+	}
+	return until, reason
+}
+
+// Returns the times messages were sent for the rate limit key after since
+func (c *CacheFile) sentSince(key string, since time.Time) []time.Time {
+	sent := []time.Time{}
+	for _, t := range c.Sent[key] {
+		if t.After(since) {
+			sent = append(sent, t)
+		}
+	}
+	return sent
+}
+
+// Records a message was sent for each of the rate limits, forgetting
+// messages older than the rate limit window
+func (c *CacheFile) RecordSent(limits []rateLimit, now time.Time) {
+	for _, limit := range limits {
+		if limit.Max <= 0 {
+			continue
+		}
+		c.Sent[limit.Key] = append(c.sentSince(limit.Key, now.Add(-time.Hour)), now)
+	}
+}
+
+// Holds the message about the entries for the recipient until the given time
+func (c *CacheFile) Hold(r pushRecipient, message *pushover.Message, entries []string, until time.Time, reason string) {
+	log.Infof("Holding %s for %s until %s: %s", message.Title, r.displayName(), until.Format(time.RFC3339), reason)
+	c.Held = append(c.Held, HeldMessage{
+		Name:     r.Name,
+		Key:      r.Key,
+		Title:    message.Title,
+		Message:  message.Message,
+		URL:      message.URL,
+		URLTitle: message.URLTitle,
+		Priority: message.Priority,
+		Sound:    message.Sound,
+		Entries:  entries,
+		Reason:   reason,
+		Held:     time.Now(),
+		Until:    until,
+	})
+}
+
+// Returns when the next held notification can be sent, or the zero time
+// if nothing is held
+func (c *CacheFile) NextHeld() time.Time {
+	next := time.Time{}
+	for _, h := range c.Held {
+		if next.IsZero() || h.Until.Before(next) {
+			next = h.Until
+		}
+	}
+	return next
+}
+
+// Returns the name of the recipient for logging
+func (r pushRecipient) displayName() string {
+	if r.Name != "" {
+		return r.Name
+	}
+	return r.Key
+}
+
+// Sends each recipient a single message with all their held notifications
+// which are due.  Notifications for users no longer in the config are dropped.
+func FlushHeld(konf *koanf.Koanf, cache *CacheFile) error {
+	now := time.Now()
+	keys := []string{}
+	due := map[string][]HeldMessage{}
+	held := []HeldMessage{}
+	for _, h := range cache.Held {
+		if h.Until.After(now) {
+			held = append(held, h)
+			continue
+		}
+		if _, ok := due[h.Key]; !ok {
+			keys = append(keys, h.Key)
+		}
+		due[h.Key] = append(due[h.Key], h)
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+
+	appKey := konf.String(PUSHOVER_APP_KEY)
+	if appKey == "" {
+		return fmt.Errorf("Missing `%s` in config", PUSHOVER_APP_KEY)
+	}
+	opts, err := LoadPushover(konf)
+	if err != nil {
+		return err
+	}
+	users, err := LoadUsers(konf)
+	if err != nil {
+		return err
+	}
+
+	app := pushover.New(appKey)
+	for _, key := range keys {
+		messages := due[key]
+		var user *User
+		if name := messages[0].Name; name != "" {
+			for i := range users {
+				if users[i].Name == name {
+					user = &users[i]
+				}
+			}
+			if user == nil {
+				log.Warnf("Dropping %d held notification(s) for unknown user %s", len(messages), name)
+				continue
+			}
+			key = user.Pushover
+		}
+		r, err := newPushRecipient(konf, opts, user, key)
+		if err != nil {
+			// keep them until the config is fixed
+			log.WithError(err).Errorf("Unable to send %d held notification(s), retrying in %s",
+				len(messages), QUEUED_RETRY_DELAY)
+			for _, h := range messages {
+				h.Until = now.Add(QUEUED_RETRY_DELAY)
+				held = append(held, h)
+			}
+			continue
+		}
+
+		message := heldMessage(messages, opts)
+		if until, reason := r.holdUntil(cache, message.Priority, now); until.After(now) {
+			log.Debugf("Still holding %d notification(s) for %s: %s", len(messages), r.displayName(), reason)
+			for _, h := range messages {
+				h.Until, h.Reason = until, reason
+				held = append(held, h)
+			}
+			continue
+		}
+		log.Infof("Sending %d held notification(s) to %s", len(messages), r.displayName())
+		titles := []string{}
+		for _, h := range messages {
+			titles = append(titles, h.Entries...)
+		}
+		if err := r.deliver(cache, app, message, now); err != nil {
+			log.WithError(err).Errorf("Unable to send held notification(s) to %s, retrying in %s",
+				r.displayName(), QUEUED_RETRY_DELAY)
+			for _, h := range messages {
+				h.Until, h.Reason = now.Add(QUEUED_RETRY_DELAY), HOLD_SEND_FAILED
+				held = append(held, h)
+			}
+			continue
+		}
+		if r.Name != "" {
+			cache.RecordNotified(titles, r.Name)
+		}
+	}
+	cache.Held = held
+	return nil
+}
+
+// Records the user was notified about the entries with the given titles
+func (c *CacheFile) RecordNotified(titles []string, name string) {
+	for i, entry := range c.Entries {
+		for _, title := range titles {
+			if entry.Title == title {
+				c.Entries[i].Notified = mergeNames(entry.Notified, []string{name})
+				break
+			}
+		}
+	}
+}
+
+// Returns a single message for the held notifications
+func heldMessage(messages []HeldMessage, opts PushoverOptions) *pushover.Message {
+	message := &pushover.Message{
+		HTML:      true,
+		Priority:  pushover.PriorityLowest,
+		Timestamp: time.Now().Unix(),
+		Retry:     opts.Retry,
+		Expire:    opts.Expire,
+		TTL:       opts.TTL,
+		Sound:     messages[0].Sound,
+	}
+	for _, h := range messages {
+		if h.Priority > message.Priority {
+			message.Priority = h.Priority
+		}
+	}
+	if len(messages) == 1 {
+		message.Title = messages[0].Title
+		message.Message = messages[0].Message
+		message.URL = messages[0].URL
+		message.URLTitle = messages[0].URLTitle
+		return message
+	}
+
+	message.Title = fmt.Sprintf("%d held notification(s)", len(messages))
+	for i, h := range messages {
+		line := html.EscapeString(h.Title) + "\n"
+		if h.URL != "" {
+			line = fmt.Sprintf("<a href=\"%s\">%s</a>\n", html.EscapeString(h.URL), html.EscapeString(h.Title))
+		}
+		more := ""
+		if i < len(messages)-1 {
+			more = fmt.Sprintf("... and %d more", len(messages)-i)
+		}
+		if utf8.RuneCountInString(message.Message+line+more) > pushover.MessageMaxLength {
+			message.Message += fmt.Sprintf("... and %d more", len(messages)-i)
+			break
+		}
+		message.Message += line
+	}
+	return message
+}
@@ -0,0 +1,152 @@
+package main
+
+/*
+ * RSS Download Tool
+ * Copyright (c) 2021 Aaron Turner  <aturner at synfin dot net>
+ *
+ * This program is free software: you can redistribute it
+ * and/or modify it under the terms of the GNU General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or with the authors permission any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gregdel/pushover"
+)
+
+func TestQuietUntil(t *testing.T) {
+	ny, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skipf("No timezone data: %s", err)
+	}
+	utc := func(month time.Month, day, hour, min int) time.Time {
+		return time.Date(2023, month, day, hour, min, 0, 0, time.UTC)
+	}
+
+	tests := []struct {
+		name     string
+		hours    string
+		timezone string
+		now      time.Time
+		until    time.Time
+		err      bool
+	}{
+		{"none", "", "UTC", utc(4, 2, 23, 0), time.Time{}, false},
+		{"same day", "09:00-17:00", "UTC", utc(4, 2, 12, 0), utc(4, 2, 17, 0), false},
+		{"same day before", "09:00-17:00", "UTC", utc(4, 2, 8, 59), time.Time{}, false},
+		{"same day at end", "09:00-17:00", "UTC", utc(4, 2, 17, 0), time.Time{}, false},
+		{"before midnight", "22:00-07:00", "UTC", utc(4, 2, 23, 30), utc(4, 3, 7, 0), false},
+		{"at start", "22:00-07:00", "UTC", utc(4, 2, 22, 0), utc(4, 3, 7, 0), false},
+		{"after midnight", "22:00-07:00", "UTC", utc(4, 3, 1, 0), utc(4, 3, 7, 0), false},
+		{"end of month", "22:00-07:00", "UTC", utc(4, 30, 23, 0), utc(5, 1, 7, 0), false},
+		{"end of year", "22:00-07:00", "UTC", time.Date(2023, 12, 31, 23, 0, 0, 0, time.UTC),
+			time.Date(2024, 1, 1, 7, 0, 0, 0, time.UTC), false},
+		{"daytime", "22:00-07:00", "UTC", utc(4, 2, 12, 0), time.Time{}, false},
+		{"at end", "22:00-07:00", "UTC", utc(4, 3, 7, 0), time.Time{}, false},
+		{"timezone", "22:00-07:00", "America/New_York", utc(4, 3, 3, 0),
+			time.Date(2023, 4, 3, 7, 0, 0, 0, ny), false},
+		{"timezone not quiet", "22:00-07:00", "America/New_York", utc(4, 2, 23, 0), time.Time{}, false},
+		// clocks went forward at 02:00 that morning
+		{"DST start", "22:00-07:00", "America/New_York", time.Date(2023, 3, 11, 23, 0, 0, 0, ny),
+			time.Date(2023, 3, 12, 7, 0, 0, 0, ny), false},
+		{"invalid hours", "10pm-7am", "UTC", utc(4, 2, 23, 0), time.Time{}, true},
+		{"invalid timezone", "22:00-07:00", "Mars/Olympus", utc(4, 2, 23, 0), time.Time{}, true},
+	}
+
+	for _, test := range tests {
+		until, err := quietUntil(test.hours, test.timezone, test.now)
+		if test.err {
+			if err == nil {
+				t.Errorf("%s: quietUntil() = %s, expected an error", test.name, until)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: quietUntil() returned error: %s", test.name, err)
+		} else if !until.Equal(test.until) {
+			t.Errorf("%s: quietUntil(%s, %s) = %s, expected %s", test.name, test.hours, test.now, until, test.until)
+		}
+	}
+}
+
+func TestHoldUntil(t *testing.T) {
+	now := time.Date(2023, 4, 2, 23, 0, 0, 0, time.UTC)
+	quiet := now.Add(8 * time.Hour)
+	cache := &CacheFile{Sent: map[string][]time.Time{
+		"user:alice": {now.Add(-90 * time.Minute), now.Add(-50 * time.Minute), now.Add(-10 * time.Minute)},
+	}}
+	limited := []rateLimit{{Key: "user:alice", Max: 2}}
+
+	tests := []struct {
+		name      string
+		recipient pushRecipient
+		priority  int
+		until     time.Time
+		reason    string
+	}{
+		{"nothing", pushRecipient{}, pushover.PriorityNormal, time.Time{}, ""},
+		{"quiet hours", pushRecipient{QuietUntil: quiet}, pushover.PriorityNormal, quiet, HOLD_QUIET_HOURS},
+		{"high priority", pushRecipient{QuietUntil: quiet}, pushover.PriorityHigh, time.Time{}, ""},
+		{"rate limit", pushRecipient{Limits: limited}, pushover.PriorityNormal,
+			now.Add(10 * time.Minute), HOLD_RATE_LIMIT},
+		{"under rate limit", pushRecipient{Limits: []rateLimit{{Key: "user:alice", Max: 3}}},
+			pushover.PriorityNormal, time.Time{}, ""},
+		{"unlimited", pushRecipient{Limits: []rateLimit{{Key: "user:alice"}}},
+			pushover.PriorityNormal, time.Time{}, ""},
+		{"quiet hours end last", pushRecipient{QuietUntil: quiet, Limits: limited},
+			pushover.PriorityNormal, quiet, HOLD_QUIET_HOURS},
+		{"high priority rate limit", pushRecipient{QuietUntil: quiet, Limits: limited},
+			pushover.PriorityHigh, now.Add(10 * time.Minute), HOLD_RATE_LIMIT},
+		{"emergency", pushRecipient{QuietUntil: quiet, Limits: limited},
+			pushover.PriorityEmergency, time.Time{}, ""},
+	}
+
+	for _, test := range tests {
+		until, reason := test.recipient.holdUntil(cache, test.priority, now)
+		if !until.Equal(test.until) || reason != test.reason {
+			t.Errorf("%s: holdUntil() = %s, %q, expected %s, %q", test.name, until, reason, test.until, test.reason)
+		}
+	}
+}
+
+func TestFlushHeldBadUser(t *testing.T) {
+	stub := newPushoverStub(t)
+	aliceKey := "u11111111111111111111111111111"
+	konf := testKonf(t, map[string]interface{}{
+		"Pushover.AppToken":      TEST_APP_TOKEN,
+		"Users.alice.Pushover":   aliceKey,
+		"Users.alice.QuietHours": "late",
+		"Users.bob.Pushover":     TEST_USER_KEY,
+	})
+	cache := testCache(t)
+	past := time.Now().Add(-time.Minute)
+	cache.Held = []HeldMessage{
+		{Name: "alice", Key: aliceKey, Title: "For alice", Message: "Hello alice", Until: past},
+		{Name: "bob", Key: TEST_USER_KEY, Title: "For bob", Message: "Hello bob", Until: past},
+	}
+
+	start := time.Now()
+	if err := FlushHeld(konf, cache); err != nil {
+		t.Fatalf("FlushHeld returned error: %s", err)
+	}
+	if sent := stub.Messages(); len(sent) != 1 || sent[0] != "For bob" {
+		t.Errorf("Sent %v, expected the message for bob", sent)
+	}
+	if len(cache.Held) != 1 || cache.Held[0].Name != "alice" {
+		t.Fatalf("Expected alice's message to still be held: %+v", cache.Held)
+	}
+	if wait := cache.Held[0].Until.Sub(start); wait < QUEUED_RETRY_DELAY || wait > QUEUED_RETRY_DELAY+time.Minute {
+		t.Errorf("Held for %s, expected %s", wait, QUEUED_RETRY_DELAY)
+	}
+}
@@ -0,0 +1,230 @@
+package main
+
+/*
+ * RSS Download Tool
+ * Copyright (c) 2021 Aaron Turner  <aturner at synfin dot net>
+ *
+ * This program is free software: you can redistribute it
+ * and/or modify it under the terms of the GNU General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or with the authors permission any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"time"
+
+	"github.com/knadh/koanf"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	EVENT_SKIPPED = "skipped" // only used in the report
+)
+
+type ReportCmd struct {
+	Cache  string `kong:"optional,name='cache',short='c',default='${CACHE_FILE}',help='Cache file'"`
+	DryRun bool   `kong:"help='Print the report instead of emailing it'"`
+}
+
+// Everything which happened since the last report
+type Report struct {
+	Start      time.Time
+	End        time.Time
+	Matches    []WebhookEvent
+	Downloads  []WebhookEvent
+	Skips      []WebhookEvent
+	Errors     []WebhookEvent
+	Disks      []ReportDisk
+	DiskErrors []string
+}
+
+// Disk status of a download target
+type ReportDisk struct {
+	Name     string
+	DiskPath string
+	Free     string
+	Avail    string
+	Used     string
+}
+
+var REPORT_TEMPLATE = template.Must(template.New("report").Parse(`<html>
+<body>
+<h2>RSS report for {{ .Start.Format "2006-01-02 15:04" }} to {{ .End.Format "2006-01-02 15:04" }}</h2>
+{{ define "entries" }}{{ if . }}<ul>
+{{ range . }}<li><a href="{{ .Entry.Url }}">{{ .Entry.Title }}</a> [{{ .Feed }}{{ if .Filter }}/{{ .Filter }}{{ end }}] {{ .Entry.TorrentSize }}</li>
+{{ end }}</ul>{{ else }}<p>None</p>{{ end }}{{ end }}
+<h3>New matches ({{ len .Matches }})</h3>
+{{ template "entries" .Matches }}
+<h3>Downloads ({{ len .Downloads }})</h3>
+{{ template "entries" .Downloads }}
+<h3>Skipped ({{ len .Skips }})</h3>
+{{ template "entries" .Skips }}
+<h3>Errors ({{ len .Errors }})</h3>
+{{ if .Errors }}<ul>
+{{ range .Errors }}<li>{{ .Time.Format "2006-01-02 15:04" }} {{ .Feed }}{{ if .Entry }}: {{ .Entry.Title }}{{ end }}: {{ .Error }}</li>
+{{ end }}</ul>{{ else }}<p>None</p>{{ end }}
+<h3>Disk status</h3>
+<table border="1" cellpadding="4">
+<tr><th>Target</th><th>DiskPath</th><th>Free</th><th>Available</th><th>Used</th></tr>
+{{ range .Disks }}<tr><td>{{ .Name }}</td><td>{{ .DiskPath }}</td><td>{{ .Free }}</td><td>{{ .Avail }}</td><td>{{ .Used }}</td></tr>
+{{ end }}</table>
+{{ range .DiskErrors }}<p>{{ . }}</p>
+{{ end }}</body>
+</html>
+`))
+
+func (cmd *ReportCmd) Run(ctx *RunContext) error {
+	cache, err := OpenCache(cmd.Cache, CacheLockTimeout(ctx.Konf))
+	if err != nil {
+		return fmt.Errorf("Unable to open cache %s: %s", cmd.Cache, err)
+	}
+	defer cache.Close()
+
+	if cmd.DryRun {
+		html, err := BuildReport(ctx.Konf, cache, time.Now()).HTML()
+		if err != nil {
+			return err
+		}
+		fmt.Print(html)
+		return nil
+	}
+	if err = SendReport(ctx.Konf, cache, time.Now()); err != nil {
+		return err
+	}
+	return cache.SaveCache()
+}
+
+// Records the event for the next report if the report is enabled
+func (c *CacheFile) RecordActivity(konf *koanf.Koanf, event WebhookEvent) {
+	if ec, enabled, _ := LoadEmail(konf); !enabled || !ec.SendReport() {
+		return
+	}
+	c.Activity = append(c.Activity, event)
+}
+
+// Returns the report of the activity since the last report
+func BuildReport(konf *koanf.Koanf, cache *CacheFile, now time.Time) Report {
+	report := Report{
+		Start:     cache.LastReport,
+		End:       now,
+		Matches:   []WebhookEvent{},
+		Downloads: []WebhookEvent{},
+		Skips:     []WebhookEvent{},
+		Errors:    []WebhookEvent{},
+		Disks:     []ReportDisk{},
+	}
+	if report.Start.IsZero() {
+		report.Start = now.Add(-24 * time.Hour)
+	}
+	for _, event := range cache.Activity {
+		switch event.Event {
+		case EVENT_MATCH:
+			report.Matches = append(report.Matches, event)
+		case EVENT_DOWNLOADED:
+			report.Downloads = append(report.Downloads, event)
+		case EVENT_SKIPPED:
+			report.Skips = append(report.Skips, event)
+		case EVENT_DOWNLOAD_FAILED, EVENT_FEED_ERROR:
+			report.Errors = append(report.Errors, event)
+		}
+	}
+
+	targets, err := LoadTargets(konf)
+	if err != nil {
+		report.DiskErrors = append(report.DiskErrors, err.Error())
+	}
+	for _, target := range targets {
+		if target.DiskPath == "" {
+			continue
+		}
+		disk, err := target.DiskUsage()
+		if err != nil {
+			report.DiskErrors = append(report.DiskErrors, fmt.Sprintf("%s: %s", target.DiskPath, err))
+			continue
+		}
+		report.Disks = append(report.Disks, ReportDisk{
+			Name:     target.Name,
+			DiskPath: target.DiskPath,
+			Free:     FormatBytes(disk.Free),
+			Avail:    FormatBytes(disk.Avail),
+			Used:     FormatBytes(disk.Used),
+		})
+	}
+	return report
+}
+
+// Returns the report as HTML
+func (r Report) HTML() (string, error) {
+	var html bytes.Buffer
+	if err := REPORT_TEMPLATE.Execute(&html, r); err != nil {
+		return "", err
+	}
+	return html.String(), nil
+}
+
+// Emails the report to Email.To and starts collecting the activity for the
+// next report
+func SendReport(konf *koanf.Koanf, cache *CacheFile, now time.Time) error {
+	ec, enabled, err := LoadEmail(konf)
+	if err != nil {
+		return err
+	} else if !enabled {
+		return fmt.Errorf("Missing `%s` in config", EMAIL)
+	}
+	html, err := BuildReport(konf, cache, now).HTML()
+	if err != nil {
+		return err
+	}
+	subject := fmt.Sprintf("RSS report for %s", now.Format("2006-01-02"))
+	if err = ec.Send(konf, ec.To, subject, html); err != nil {
+		return fmt.Errorf("Unable to email report: %w", err)
+	}
+	log.Infof("Emailed report to %d address(es)", len(ec.To))
+	cache.Activity = []WebhookEvent{}
+	cache.LastReport = now
+	return nil
+}
+
+// Returns the policy for when to send the report
+func (ec EmailConfig) reportPolicy() *DigestPolicy {
+	return &DigestPolicy{Times: []string{ec.ReportTime}, Timezone: ec.Timezone}
+}
+
+// Returns when the next report is due or the zero time if the report is
+// disabled.  The first report is due at the ReportTime after we started
+// collecting activity.
+func NextReport(konf *koanf.Koanf, cache *CacheFile) time.Time {
+	ec, enabled, err := LoadEmail(konf)
+	if err != nil || !enabled || !ec.SendReport() {
+		return time.Time{}
+	}
+	if cache.LastReport.IsZero() {
+		cache.LastReport = time.Now()
+	}
+	next, err := ec.reportPolicy().NextSend(cache.LastReport)
+	if err != nil {
+		return time.Time{}
+	}
+	return next
+}
+
+// Sends the report if it is due
+func sendReportIfDue(konf *koanf.Koanf, cache *CacheFile) error {
+	now := time.Now()
+	next := NextReport(konf, cache)
+	if next.IsZero() || next.After(now) {
+		return nil
+	}
+	return SendReport(konf, cache, now)
+}
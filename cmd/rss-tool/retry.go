@@ -0,0 +1,147 @@
+package main
+
+/*
+ * RSS Download Tool
+ * Copyright (c) 2021 Aaron Turner  <aturner at synfin dot net>
+ *
+ * This program is free software: you can redistribute it
+ * and/or modify it under the terms of the GNU General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or with the authors permission any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/knadh/koanf"
+	"github.com/mmcdole/gofeed"
+	log "github.com/sirupsen/logrus"
+	syscall "golang.org/x/sys/unix"
+)
+
+const (
+	RETRY_ATTEMPTS  = "Retry.Attempts"
+	RETRY_DELAY     = "Retry.Delay"
+	RETRY_MAX_DELAY = "Retry.MaxDelay"
+	RETRY_TIMEOUT   = "Retry.Timeout"
+)
+
+// How to retry network requests which fail with a transient error
+type RetryPolicy struct {
+	Attempts int           // total number of tries
+	Delay    time.Duration // before the first retry, doubled for each retry
+	MaxDelay time.Duration // longest we wait between tries
+	Timeout  time.Duration // for each try
+}
+
+// Returns the Retry policy from our config with the defaults for any
+// missing values
+func LoadRetryPolicy(konf *koanf.Koanf) RetryPolicy {
+	rp := RetryPolicy{
+		Attempts: 3,
+		Delay:    2 * time.Second,
+		MaxDelay: 30 * time.Second,
+		Timeout:  60 * time.Second,
+	}
+	if konf.Exists(RETRY_ATTEMPTS) {
+		rp.Attempts = konf.Int(RETRY_ATTEMPTS)
+	}
+	if d := konf.Duration(RETRY_DELAY); d > 0 {
+		rp.Delay = d
+	}
+	if d := konf.Duration(RETRY_MAX_DELAY); d > 0 {
+		rp.MaxDelay = d
+	}
+	if d := konf.Duration(RETRY_TIMEOUT); d > 0 {
+		rp.Timeout = d
+	}
+	if rp.Attempts < 1 {
+		rp.Attempts = 1
+	}
+	return rp
+}
+
+// Returns an http.Client using our Timeout
+func (rp RetryPolicy) Client() *http.Client {
+	return &http.Client{Timeout: rp.Timeout}
+}
+
+// Calls fn until it succeeds, returns a permanent error or we run out of
+// attempts.  Waits with exponential backoff and jitter between tries.
+func (rp RetryPolicy) Do(what string, fn func() error) error {
+	var err error
+	delay := rp.Delay
+	for attempt := 1; ; attempt++ {
+		if err = fn(); err == nil || !IsTransient(err) || attempt >= rp.Attempts {
+			return err
+		}
+		// sleep between delay/2 and delay
+		sleep := delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+		log.WithError(err).Warnf("%s failed (attempt %d of %d), retrying in %s",
+			what, attempt, rp.Attempts, sleep.Round(time.Millisecond))
+		time.Sleep(sleep)
+		if delay *= 2; delay > rp.MaxDelay {
+			delay = rp.MaxDelay
+		}
+	}
+}
+
+// Non-2xx HTTP response
+type HttpStatusError struct {
+	Url        string
+	StatusCode int
+	Status     string
+}
+
+func (e HttpStatusError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Url, e.Status)
+}
+
+// Is the HTTP status worth retrying?
+func transientStatus(code int) bool {
+	return code >= 500 || code == http.StatusRequestTimeout || code == http.StatusTooManyRequests
+}
+
+// Returns true if the error is likely to go away if we try again:
+// timeouts, connection problems and 5xx responses.  4xx responses and
+// parse errors are permanent.
+func IsTransient(err error) bool {
+	var statusErr HttpStatusError
+	if errors.As(err, &statusErr) {
+		return transientStatus(statusErr.StatusCode)
+	}
+	var feedErr gofeed.HTTPError
+	if errors.As(err, &feedErr) {
+		return transientStatus(feedErr.StatusCode)
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return dnsErr.IsTemporary || dnsErr.IsTimeout
+	}
+	var opErr *net.OpError
+	if errors.As(err, &opErr) {
+		return true
+	}
+	return errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.ECONNABORTED) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, io.EOF)
+}
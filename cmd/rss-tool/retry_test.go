@@ -0,0 +1,74 @@
+package main
+
+/*
+ * RSS Download Tool
+ * Copyright (c) 2021 Aaron Turner  <aturner at synfin dot net>
+ *
+ * This program is free software: you can redistribute it
+ * and/or modify it under the terms of the GNU General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or with the authors permission any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"testing"
+
+	"github.com/mmcdole/gofeed"
+	syscall "golang.org/x/sys/unix"
+)
+
+// A net.Error which timed out
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestIsTransient(t *testing.T) {
+	tests := []struct {
+		name      string
+		err       error
+		transient bool
+	}{
+		{"500", HttpStatusError{StatusCode: 500, Status: "500 Internal Server Error"}, true},
+		{"503 wrapped", fmt.Errorf("Unable to download: %w", HttpStatusError{StatusCode: 503}), true},
+		{"408", HttpStatusError{StatusCode: 408}, true},
+		{"429", HttpStatusError{StatusCode: 429}, true},
+		{"404", HttpStatusError{StatusCode: 404}, false},
+		{"403", HttpStatusError{StatusCode: 403}, false},
+		{"gofeed 502", gofeed.HTTPError{StatusCode: 502, Status: "502 Bad Gateway"}, true},
+		{"gofeed 404", gofeed.HTTPError{StatusCode: 404, Status: "404 Not Found"}, false},
+		{"timeout", &url.Error{Op: "Get", URL: "http://example.com", Err: timeoutError{}}, true},
+		{"dns temporary", &net.DNSError{Err: "server misbehaving", IsTemporary: true}, true},
+		{"dns timeout", &net.DNSError{Err: "timeout", IsTimeout: true}, true},
+		{"dns not found", &url.Error{Op: "Get", URL: "http://nope.invalid",
+			Err: &net.OpError{Op: "dial", Err: &net.DNSError{Err: "no such host", IsNotFound: true}}}, false},
+		{"connection refused", &url.Error{Op: "Get", URL: "http://example.com",
+			Err: &net.OpError{Op: "dial", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}}, true},
+		{"connection reset", fmt.Errorf("read: %w", syscall.ECONNRESET), true},
+		{"unexpected EOF", fmt.Errorf("Unable to read: %w", io.ErrUnexpectedEOF), true},
+		{"EOF", &url.Error{Op: "Get", URL: "http://example.com", Err: io.EOF}, true},
+		{"parse error", errors.New("Failed to detect feed type"), false},
+		{"no such file", &os.PathError{Op: "open", Path: "/nope", Err: syscall.ENOENT}, false},
+	}
+
+	for _, test := range tests {
+		if transient := IsTransient(test.err); transient != test.transient {
+			t.Errorf("%s: IsTransient(%v) = %t, expected %t", test.name, test.err, transient, test.transient)
+		}
+	}
+}
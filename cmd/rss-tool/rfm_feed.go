@@ -22,7 +22,9 @@ import (
 	"fmt"
 	"reflect"
 	"regexp"
+	"sort"
 	"strings"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 )
@@ -35,8 +37,10 @@ const (
 type RfmFeed struct {
 	FeedType         string
 	Order            int                   `koanf:"Order"`
+	Interval         time.Duration         `koanf:"Interval"`
 	AutoDownload     bool                  `koanf:"AutoDownload"`
 	DownloadPath     string                `koanf:"DownloadPath"`
+	FilenameTemplate string                `koanf:"FilenameTemplate"`
 	BaseUrl          string                `koanf:"BaseUrl"`
 	Filters          *map[string]RssFilter `koanf:"Filters"`
 	Results          int64                 `koanf:"Results" param:"l"`
@@ -46,34 +50,36 @@ type RfmFeed struct {
 	StartDate        string                `koanf:"StartDate" param:"sd"`
 	EndDate          string                `koanf:"EndDate" param:"ed"`
 	SearchDecription bool                  `koanf:"SearchDecription" param:"d"`
+	PublishFormats   []string              `koanf:"PublishFormats"`
+	Timezone         string                `koanf:"Timezone"`
+	ErrorPolicy      *ErrorPolicy          `koanf:"ErrorPolicy"`
+	Pushover         *PushoverOptions      `koanf:"Pushover"`
 }
 
-// hack around RSS_FEED_TYPES causing stale data to be left around
-func (rfm *RfmFeed) Reset() {
-	rfm.FeedType = "RFM"
-	rfm.AutoDownload = false
-	rfm.DownloadPath = ""
-	rfm.BaseUrl = ""
-	rfm.Order = 0
-	rfm.Filters = &map[string]RssFilter{}
-	rfm.Results = 0
-	rfm.Category = 0
-	rfm.Terms = []string{}
-	rfm.Uploader = ""
-	rfm.StartDate = ""
-	rfm.EndDate = ""
-	rfm.SearchDecription = false
+// Returns a new RfmFeed to unmarshal a feed's config into
+func NewRfmFeed() RssFeed {
+	return &RfmFeed{
+		FeedType:       "RFM",
+		Filters:        &map[string]RssFilter{},
+		Terms:          []string{},
+		PublishFormats: []string{},
+	}
 }
 
 func (rfm *RfmFeed) GetFilters() map[string]RssFilter {
 	return *rfm.Filters
 }
 
-func (rfm *RfmFeed) DownloadFilename(basePath string, entry RssFeedEntry) string {
-	return basePath + fmt.Sprintf("/%s.torrent", entry.Title)
+// Returns the path to save the torrent for the entry using our FilenameTemplate
+func (rfm *RfmFeed) DownloadFilename(basePath string, entry RssFeedEntry) (string, error) {
+	return RenderFilename(basePath, rfm.FilenameTemplate, entry)
 }
 
 func (rfm *RfmFeed) GenerateUrl() string {
+	if IsLocalFeed(rfm.BaseUrl) {
+		// local files don't take any query parameters
+		return rfm.BaseUrl
+	}
 	urlParts := []string{}
 	if len(rfm.Terms) > 0 {
 		p, _ := rfm.GetParam("Terms")
@@ -106,8 +112,29 @@ func (rfm *RfmFeed) GenerateUrl() string {
 	return fmt.Sprintf("%s?%s", rfm.BaseUrl, strings.Join(urlParts, "&"))
 }
 
-func (rfm *RfmFeed) GetPublishFormat() string {
-	return RFM_PUBLISH_FORMAT
+func (rfm *RfmFeed) GetPublishFormats() []string {
+	if len(rfm.PublishFormats) > 0 {
+		return rfm.PublishFormats
+	}
+	return []string{RFM_PUBLISH_FORMAT}
+}
+
+// Returns the timezone for Published times without one. Defaults to UTC.
+func (rfm *RfmFeed) GetLocation() *time.Location {
+	loc, err := time.LoadLocation(rfm.Timezone)
+	if err != nil {
+		log.WithError(err).Errorf("Invalid Timezone: %s", rfm.Timezone)
+		return time.UTC
+	}
+	return loc
+}
+
+func (rfm *RfmFeed) GetErrorPolicy() *ErrorPolicy {
+	return rfm.ErrorPolicy
+}
+
+func (rfm *RfmFeed) GetPushover() *PushoverOptions {
+	return rfm.Pushover
 }
 
 func (rfm *RfmFeed) GetFeedType() string {
@@ -118,6 +145,10 @@ func (rfm RfmFeed) GetOrder() int {
 	return rfm.Order
 }
 
+func (rfm RfmFeed) GetInterval() time.Duration {
+	return rfm.Interval
+}
+
 func (rfm RfmFeed) GetDownloadPath() string {
 	return rfm.DownloadPath
 }
@@ -143,6 +174,9 @@ func (rfm *RfmFeed) UrlRewriter(url string) string {
 func (rf *RfmFeed) Match(entry RssFeedEntry) (bool, string) {
 	log.Debugf("Looking for match of %s / %s", entry.Title, strings.Join(entry.Categories, ","))
 	for fname, filter := range *rf.Filters {
+		if !filter.CheckSize(entry.TorrentBytes) {
+			continue
+		}
 		for _, c := range entry.Categories {
 			if filter.HasCategory(c) {
 				if filter.Match(entry.Title) || filter.Match(entry.Description) {
@@ -153,3 +187,49 @@ func (rf *RfmFeed) Match(entry RssFeedEntry) (bool, string) {
 	}
 	return false, ""
 }
+
+// Explains how each filter handled the given entry
+func (rf *RfmFeed) Explain(entry RssFeedEntry) []FilterResult {
+	names := []string{}
+	for fname := range *rf.Filters {
+		names = append(names, fname)
+	}
+	sort.Strings(names)
+
+	results := []FilterResult{}
+	for _, fname := range names {
+		filter := (*rf.Filters)[fname]
+		result := FilterResult{Filter: fname}
+		for _, c := range entry.Categories {
+			if filter.HasCategory(c) {
+				result.CategoryOK = true
+				result.Category = c
+				break
+			}
+		}
+
+		result.SizeOK = filter.CheckSize(entry.TorrentBytes)
+
+		if result.CategoryOK && result.SizeOK {
+			fields := []struct{ name, value string }{
+				{"Title", entry.Title},
+				{"Description", entry.Description},
+			}
+			for _, field := range fields {
+				search, exclude := filter.Check(field.value)
+				if search == "" {
+					continue
+				}
+				result.Field = field.name
+				result.Search = search
+				result.Exclude = exclude
+				if exclude == "" {
+					result.Match = true
+					break
+				}
+			}
+		}
+		results = append(results, result)
+	}
+	return results
+}
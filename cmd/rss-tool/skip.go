@@ -20,6 +20,7 @@ package main
 
 import (
 	"fmt"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 )
@@ -28,77 +29,44 @@ type SkipCmd struct {
 	Feed    string   `kong:"arg,optional,help='Specify feed name to skip entries for'"`
 	Filters []string `kong:"arg,optional,help='Specify optional filters to use (default all)'"`
 	Cache   string   `kong:"optional,name='cache',short='c',default='${CACHE_FILE}',help='Cache file'"`
+	Input   string   `kong:"optional,name='input',short='i',help='Read the feed from this file (- for stdin) instead of the network'"`
 }
 
 func (cmd *SkipCmd) Run(ctx *RunContext) error {
-	allFeeds := ctx.Konf.MapKeys("Feeds")
-	feeds := []string{}
-
-	if ctx.Cli.Skip.Feed != "" {
-		for _, feed := range allFeeds {
-			if feed == ctx.Cli.Skip.Feed {
-				feeds = append(feeds, ctx.Cli.Skip.Feed)
-				break
-			}
-		}
-		if len(feeds) == 0 {
-			return fmt.Errorf("Invalid feed name: %s", ctx.Cli.Skip.Feed)
-		}
-	} else {
-		// add our feeds in the specified order
-		feedCnt := len(allFeeds)
-		for i := 1; i <= feedCnt; i++ {
-			for _, feed := range allFeeds {
-				order := ctx.Konf.Int(fmt.Sprintf("Feeds.%s.Order", feed))
-				if order == i {
-					feeds = append(feeds, feed)
-				}
-			}
-		}
+	if ctx.Cli.Skip.Input != "" && ctx.Cli.Skip.Feed == "" {
+		return fmt.Errorf("--input requires a feed name")
+	}
 
-		// look for any feeds which don't have an order
-		for _, feed := range allFeeds {
-			hasOrder := false
-			for _, x := range feeds {
-				if feed == x {
-					hasOrder = true
-					break
-				}
-			}
-			if !hasOrder {
-				feeds = append(feeds, feed)
-			}
-		}
+	feeds, err := SortedFeeds(ctx.Konf, ctx.Cli.Skip.Feed)
+	if err != nil {
+		return err
 	}
 	log.Debugf("Feeds = %v", feeds)
 
-	for _, feed := range feeds {
-		err := skip(ctx, feed)
-		if err != nil {
-			return err
-		}
+	cache, err := OpenCache(ctx.Cli.Skip.Cache, CacheLockTimeout(ctx.Konf))
+	if err != nil {
+		return fmt.Errorf("Unable to open cache %s: %s", ctx.Cli.Skip.Cache, err)
 	}
-	return nil
+	// deferred first, so the webhooks are sent after the cache is unlocked
+	defer SendPublished(ctx.Konf, cache)
+	defer cache.Close()
+
+	err = processFeeds(ctx.Konf, cache, false, feeds, func(feedName string) error {
+		return skip(ctx, cache, feedName)
+	})
+	if saveErr := cache.SaveCache(); saveErr != nil {
+		return saveErr
+	}
+	return err
 }
 
-func skip(ctx *RunContext, feedName string) error {
+func skip(ctx *RunContext, cache *CacheFile, feedName string) error {
 	log.Infof("Processing: %s", feedName)
 	// get our feed
-	feedType := ctx.Konf.String(fmt.Sprintf("Feeds.%s.FeedType", feedName))
-	if feedType == "" {
-		return fmt.Errorf("Missing FeedType for %s", feedName)
-	}
-	feed, ok := RSS_FEED_TYPES[feedType]
-	if !ok {
-		return fmt.Errorf("Unknown feed type: %s", feedType)
-	}
-	feed.Reset()
-
-	err := ctx.Konf.Unmarshal(fmt.Sprintf("Feeds.%s", feedName), feed)
+	feed, err := LoadFeed(ctx.Konf, feedName)
 	if err != nil {
 		return err
 	}
-	log.Debugf("Feed: %v", feed)
 
 	// which filters to enable
 	filters := []string{}
@@ -110,7 +78,7 @@ func skip(ctx *RunContext, feedName string) error {
 		}
 	}
 
-	newEntries, err := DownloadFeed(feedName, RssFeed(feed))
+	newEntries, err := DownloadFeed(ctx.Konf, feedName, feed, ctx.Cli.Skip.Input)
 	if err != nil {
 		return err
 	}
@@ -120,19 +88,21 @@ func skip(ctx *RunContext, feedName string) error {
 		return err
 	}
 
-	// load our cache
-	cache, err := OpenCache(ctx.Cli.Skip.Cache)
-	if err != nil {
-		log.WithError(err).Panicf("Unable to open cache: %s", ctx.Cli.Skip.Cache)
-	}
-
 	for _, entry := range filteredEntries {
 		if !RssFeedEntryExits(cache.Entries, entry) {
 			log.Infof("Skipping entry: %s", entry.Title)
 			cache.Entries = append(cache.Entries, entry)
+			skipped := entry
+			cache.RecordActivity(ctx.Konf, WebhookEvent{
+				Event:  EVENT_SKIPPED,
+				Time:   time.Now(),
+				Feed:   entry.FeedName,
+				Filter: entry.Filter,
+				Entry:  &skipped,
+			})
 		} else {
 			log.Debugf("Entry %s already exists in cache", entry.Title)
 		}
 	}
-	return cache.SaveCache()
+	return nil
 }
@@ -0,0 +1,288 @@
+package main
+
+/*
+ * RSS Download Tool
+ * Copyright (c) 2021 Aaron Turner  <aturner at synfin dot net>
+ *
+ * This program is free software: you can redistribute it
+ * and/or modify it under the terms of the GNU General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or with the authors permission any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/knadh/koanf"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	TARGETS            = "Targets"
+	PLACEMENT          = "Placement"
+	PLACEMENT_POLICIES = "most-free,first-fit,category"
+	DEFAULT_PLACEMENT  = "most-free"
+)
+
+// A disk we can download to
+type DownloadTarget struct {
+	Name         string   `koanf:"-"`
+	Order        int      `koanf:"Order"`
+	DiskPath     string   `koanf:"DiskPath"`     // disk to check for free space
+	DiskBuffer   string   `koanf:"DiskBuffer"`   // space to always leave free
+	DiskUsed     string   `koanf:"DiskUsed"`     // how to calculate Used: walk, statfs or none
+	DiskUsedTTL  string   `koanf:"DiskUsedTTL"`  // how long to cache the walk
+	DownloadPath string   `koanf:"DownloadPath"` // torrent files go here, default is the feed's
+	Categories   []string `koanf:"Categories"`   // used by the category placement policy
+}
+
+// Returns our download targets sorted by Order.  Without any `Targets`
+// the global DiskPath & DiskBuffer are used as the only target.  The
+// global DiskUsed & DiskUsedTTL are the default for every target.
+func LoadTargets(konf *koanf.Koanf) ([]DownloadTarget, error) {
+	names := konf.MapKeys(TARGETS)
+	if len(names) == 0 {
+		return []DownloadTarget{
+			{
+				DiskPath:    konf.String(DISK_PATH),
+				DiskBuffer:  konf.String(DISK_BUFFER),
+				DiskUsed:    konf.String(DISK_USED),
+				DiskUsedTTL: konf.String(DISK_USED_TTL),
+			},
+		}, nil
+	}
+
+	targets := []DownloadTarget{}
+	for _, name := range names {
+		target := DownloadTarget{}
+		if err := konf.Unmarshal(fmt.Sprintf("%s.%s", TARGETS, name), &target); err != nil {
+			return targets, fmt.Errorf("Unable to load %s.%s: %s", TARGETS, name, err)
+		}
+		target.Name = name
+		if target.DiskUsed == "" {
+			target.DiskUsed = konf.String(DISK_USED)
+		}
+		if target.DiskUsedTTL == "" {
+			target.DiskUsedTTL = konf.String(DISK_USED_TTL)
+		}
+		targets = append(targets, target)
+	}
+	sort.SliceStable(targets, func(i, j int) bool {
+		if targets[i].Order == targets[j].Order {
+			return targets[i].Name < targets[j].Name
+		}
+		return targets[i].Order < targets[j].Order
+	})
+	return targets, nil
+}
+
+// Returns the placement policy to use
+func Placement(konf *koanf.Koanf) string {
+	if placement := konf.String(PLACEMENT); placement != "" {
+		return placement
+	}
+	return DEFAULT_PLACEMENT
+}
+
+// Where to write the torrent file for the given feed
+func (t *DownloadTarget) GetDownloadPath(feed RssFeed) string {
+	if t.DownloadPath != "" {
+		return t.DownloadPath
+	}
+	return feed.GetDownloadPath()
+}
+
+// disk usage of the target
+func (t *DownloadTarget) DiskUsage() (DiskStatus, error) {
+	ttl, err := t.usedTTL()
+	if err != nil {
+		return DiskStatus{}, err
+	}
+	return DiskUsage(t.DiskPath, t.DiskBuffer, t.DiskUsed, ttl)
+}
+
+// How long to cache the size of DiskPath
+func (t *DownloadTarget) usedTTL() (time.Duration, error) {
+	if t.DiskUsedTTL == "" {
+		return DEFAULT_DISK_USED_TTL, nil
+	}
+	ttl, err := time.ParseDuration(t.DiskUsedTTL)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid %s: %s", DISK_USED_TTL, err)
+	}
+	return ttl, nil
+}
+
+// Does the target take any of the entry's categories?
+func (t *DownloadTarget) HasCategory(entry RssFeedEntry) bool {
+	for _, c := range t.Categories {
+		for _, ec := range append(entry.Categories, entry.TorrentCategories...) {
+			if c == ec {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Returns the targets the placement policy allows for the given entry
+func candidateTargets(placement string, targets []DownloadTarget, entry RssFeedEntry) []DownloadTarget {
+	if placement != "category" {
+		return targets
+	}
+	matched := []DownloadTarget{}
+	fallback := []DownloadTarget{}
+	for _, target := range targets {
+		if target.HasCategory(entry) {
+			matched = append(matched, target)
+		} else if len(target.Categories) == 0 {
+			fallback = append(fallback, target)
+		}
+	}
+	if len(matched) > 0 {
+		return matched
+	}
+	return fallback
+}
+
+// Picks the target to download the entry to based on our placement
+// policy.  If the entry doesn't fit anywhere, the target with the most
+// space is returned along with ErrNoSpace.  space may be nil.
+func SelectTarget(konf *koanf.Koanf, entry RssFeedEntry, space *SpaceTracker) (DownloadTarget, DiskStatus, error) {
+	targets, err := LoadTargets(konf)
+	if err != nil {
+		return DownloadTarget{}, DiskStatus{}, err
+	}
+	placement := Placement(konf)
+	candidates := candidateTargets(placement, targets, entry)
+	if len(candidates) == 0 {
+		return DownloadTarget{}, DiskStatus{}, fmt.Errorf("No download target for %s with categories %v",
+			entry.Title, append(entry.Categories, entry.TorrentCategories...))
+	}
+
+	var best *DownloadTarget
+	var bestDisk DiskStatus
+	var bestFree uint64
+	var lastErr error
+	for i := range candidates {
+		target := &candidates[i]
+		if target.DiskPath == "" {
+			// no DiskPath configured, so we can't check for space
+			return *target, DiskStatus{}, nil
+		}
+		disk, err := target.DiskUsage()
+		if err != nil {
+			// an unmounted disk shouldn't stop downloads to the others
+			log.WithError(err).Warnf("Skipping download target %s", target.DiskPath)
+			lastErr = err
+			continue
+		}
+		var committed uint64
+		if space != nil {
+			committed = space.Committed(target.DiskPath)
+		}
+		var free uint64
+		if disk.Avail > committed {
+			free = disk.Avail - committed
+		}
+		fits := free >= entry.TorrentBytes
+		if fits && placement != "most-free" {
+			// first-fit & category use the first target in Order
+			return *target, disk, nil
+		}
+		if best == nil || free > bestFree {
+			best, bestDisk, bestFree = target, disk, free
+		}
+	}
+
+	if best == nil {
+		return DownloadTarget{}, DiskStatus{}, fmt.Errorf("No usable download target for %s: %s", entry.Title, lastErr)
+	}
+	if bestFree >= entry.TorrentBytes {
+		return *best, bestDisk, nil
+	}
+	return *best, bestDisk, fmt.Errorf("%w to download %s: need %s, have %s on %s",
+		ErrNoSpace, entry.Title, FormatBytes(entry.TorrentBytes), FormatBytes(bestFree), best.DiskPath)
+}
+
+// Validate the download targets
+func validateTargets(konf *koanf.Koanf) []string {
+	problems := []string{}
+	placement := Placement(konf)
+	if !inList(PLACEMENT_POLICIES, placement) {
+		problems = append(problems, fmt.Sprintf("%s: invalid policy %s, must be one of %s",
+			PLACEMENT, placement, PLACEMENT_POLICIES))
+	}
+
+	targets, err := LoadTargets(konf)
+	if err != nil {
+		return append(problems, err.Error())
+	}
+	for _, target := range targets {
+		prefix := fmt.Sprintf("%s.%s.", TARGETS, target.Name)
+		if target.Name == "" {
+			prefix = ""
+		}
+		if _, err := ParseBytes(target.DiskBuffer); err != nil {
+			problems = append(problems, fmt.Sprintf("%s%s: %s", prefix, DISK_BUFFER, err))
+		}
+		if target.DiskUsed != "" && !inList(DISK_USED_MODES, target.DiskUsed) {
+			problems = append(problems, fmt.Sprintf("%s%s: invalid mode %s, must be one of %s",
+				prefix, DISK_USED, target.DiskUsed, DISK_USED_MODES))
+		}
+		if _, err := target.usedTTL(); err != nil {
+			problems = append(problems, fmt.Sprintf("%s%s", prefix, err))
+		}
+		if target.DiskPath == "" {
+			if target.Name != "" {
+				problems = append(problems, fmt.Sprintf("%s%s: missing", prefix, DISK_PATH))
+			}
+		} else if err := checkWritableDir(target.DiskPath); err != nil {
+			problems = append(problems, fmt.Sprintf("%s%s: %s", prefix, DISK_PATH, err))
+		}
+		if target.DownloadPath != "" {
+			if err := checkWritableDir(target.DownloadPath); err != nil {
+				problems = append(problems, fmt.Sprintf("%sDownloadPath: %s", prefix, err))
+			}
+		} else if len(targets) > 1 {
+			// otherwise every target writes to the feed's DownloadPath
+			problems = append(problems, fmt.Sprintf("%sDownloadPath: required with more than one target", prefix))
+		}
+		if _, err := target.GetRetention(konf); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+	return problems
+}
+
+// Do any targets use the feed's DownloadPath?
+func targetsNeedDownloadPath(konf *koanf.Koanf) bool {
+	targets, _ := LoadTargets(konf)
+	for _, target := range targets {
+		if target.DownloadPath == "" {
+			return true
+		}
+	}
+	return len(targets) == 0
+}
+
+// Is value one of the items in the comma separated list?
+func inList(list, value string) bool {
+	for _, item := range strings.Split(list, ",") {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,109 @@
+package main
+
+/*
+ * RSS Download Tool
+ * Copyright (c) 2021 Aaron Turner  <aturner at synfin dot net>
+ *
+ * This program is free software: you can redistribute it
+ * and/or modify it under the terms of the GNU General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or with the authors permission any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+type TestFilterCmd struct {
+	Feed    string   `kong:"arg,required,help='Specify feed name whose filters to test'"`
+	File    string   `kong:"arg,required,type='existingfile',help='Saved feed XML or download JSON/JSONL file'"`
+	Filters []string `kong:"arg,optional,help='Specify optional filters to use (default all)'"`
+	Format  string   `kong:"optional,name='format',short='f',default='text',enum='text,json',help='Output format [text|json]'"`
+}
+
+// The result of running the filters against a single entry
+type TestFilterResult struct {
+	Title      string         `json:"Title"`
+	Categories []string       `json:"Categories"`
+	Selected   bool           `json:"Selected"`         // would push/download select this entry?
+	Filter     string         `json:"Filter,omitempty"` // filter which selected the entry
+	Results    []FilterResult `json:"Results"`
+}
+
+func (cmd *TestFilterCmd) Run(ctx *RunContext) error {
+	feed, err := LoadFeed(ctx.Konf, ctx.Cli.TestFilter.Feed)
+	if err != nil {
+		return err
+	}
+
+	// which filters to enable
+	filters := []string{}
+	if len(ctx.Cli.TestFilter.Filters) != 0 {
+		filters = append(filters, ctx.Cli.TestFilter.Filters...)
+	} else {
+		for filter := range feed.GetFilters() {
+			filters = append(filters, filter)
+		}
+	}
+
+	entries, err := ReadFeedFile(ctx.Cli.TestFilter.Feed, feed, ctx.Cli.TestFilter.File)
+	if err != nil {
+		return err
+	}
+
+	results := []TestFilterResult{}
+	for _, entry := range entries {
+		result := TestFilterResult{
+			Title:      entry.Title,
+			Categories: entry.Categories,
+			Results:    []FilterResult{},
+		}
+		selected, err := FilterEntries([]RssFeedEntry{entry}, feed, filters)
+		if err != nil {
+			return err
+		}
+		if len(selected) > 0 {
+			result.Selected = true
+			result.Filter = selected[0].Filter
+		}
+		for _, fr := range feed.Explain(entry) {
+			for _, filter := range filters {
+				if fr.Filter == filter {
+					result.Results = append(result.Results, fr)
+				}
+			}
+		}
+		results = append(results, result)
+	}
+
+	if ctx.Cli.TestFilter.Format == "json" {
+		b, err := json.MarshalIndent(results, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s\n", b)
+		return nil
+	}
+
+	for i, result := range results {
+		selected := "skip"
+		if result.Selected {
+			selected = fmt.Sprintf("SELECTED by %s", result.Filter)
+		}
+		fmt.Printf("%d %s {%s} [%s]\n", i, result.Title, strings.Join(result.Categories, ", "), selected)
+		for _, fr := range result.Results {
+			fmt.Printf("\t%s\n", fr.Sprint())
+		}
+	}
+	return nil
+}
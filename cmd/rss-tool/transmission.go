@@ -0,0 +1,146 @@
+package main
+
+/*
+ * RSS Download Tool
+ * Copyright (c) 2021 Aaron Turner  <aturner at synfin dot net>
+ *
+ * This program is free software: you can redistribute it
+ * and/or modify it under the terms of the GNU General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or with the authors permission any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const (
+	TRANSMISSION_SESSION_HEADER = "X-Transmission-Session-Id"
+	TRANSMISSION_TIMEOUT        = 30 * time.Second
+)
+
+// Talks to Transmission via its JSON RPC interface
+type TransmissionClient struct {
+	url       string
+	username  string
+	password  string
+	sessionId string
+	http      *http.Client
+}
+
+type transmissionRequest struct {
+	Method    string      `json:"method"`
+	Arguments interface{} `json:"arguments,omitempty"`
+}
+
+type transmissionResponse struct {
+	Result    string          `json:"result"`
+	Arguments json.RawMessage `json:"arguments"`
+}
+
+func NewTransmissionClient(url, username, password string) *TransmissionClient {
+	return &TransmissionClient{
+		url:      url,
+		username: username,
+		password: password,
+		http:     &http.Client{Timeout: TRANSMISSION_TIMEOUT},
+	}
+}
+
+// Makes an RPC call, handling the session id handshake
+func (t *TransmissionClient) call(method string, args interface{}, result interface{}) error {
+	body, err := json.Marshal(transmissionRequest{Method: method, Arguments: args})
+	if err != nil {
+		return err
+	}
+
+	var resp *http.Response
+	for i := 0; i < 2; i++ {
+		req, err := http.NewRequest(http.MethodPost, t.url, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set(TRANSMISSION_SESSION_HEADER, t.sessionId)
+		if t.username != "" {
+			req.SetBasicAuth(t.username, t.password)
+		}
+		resp, err = t.http.Do(req)
+		if err != nil {
+			return fmt.Errorf("Transmission %s: %s", method, err)
+		}
+		if resp.StatusCode != http.StatusConflict {
+			break
+		}
+		// 409 means we need to use the new session id
+		resp.Body.Close()
+		t.sessionId = resp.Header.Get(TRANSMISSION_SESSION_HEADER)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Transmission %s: %s", method, resp.Status)
+	}
+
+	tresp := transmissionResponse{}
+	if err = json.NewDecoder(resp.Body).Decode(&tresp); err != nil {
+		return fmt.Errorf("Transmission %s: %s", method, err)
+	}
+	if tresp.Result != "success" {
+		return fmt.Errorf("Transmission %s: %s", method, tresp.Result)
+	}
+	if result != nil {
+		return json.Unmarshal(tresp.Arguments, result)
+	}
+	return nil
+}
+
+func (t *TransmissionClient) Torrents() ([]ClientTorrent, error) {
+	args := map[string]interface{}{
+		"fields": []string{"id", "name", "downloadDir", "sizeWhenDone", "leftUntilDone"},
+	}
+	result := struct {
+		Torrents []struct {
+			Id            int64  `json:"id"`
+			Name          string `json:"name"`
+			DownloadDir   string `json:"downloadDir"`
+			SizeWhenDone  uint64 `json:"sizeWhenDone"`
+			LeftUntilDone uint64 `json:"leftUntilDone"`
+		} `json:"torrents"`
+	}{}
+	if err := t.call("torrent-get", args, &result); err != nil {
+		return []ClientTorrent{}, err
+	}
+
+	torrents := []ClientTorrent{}
+	for _, t := range result.Torrents {
+		torrents = append(torrents, ClientTorrent{
+			Id:            t.Id,
+			Name:          t.Name,
+			DownloadDir:   t.DownloadDir,
+			SizeWhenDone:  t.SizeWhenDone,
+			LeftUntilDone: t.LeftUntilDone,
+		})
+	}
+	return torrents, nil
+}
+
+func (t *TransmissionClient) Remove(ids []int64, deleteData bool) error {
+	args := map[string]interface{}{
+		"ids":               ids,
+		"delete-local-data": deleteData,
+	}
+	return t.call("torrent-remove", args, nil)
+}
@@ -0,0 +1,169 @@
+package main
+
+/*
+ * RSS Download Tool
+ * Copyright (c) 2021 Aaron Turner  <aturner at synfin dot net>
+ *
+ * This program is free software: you can redistribute it
+ * and/or modify it under the terms of the GNU General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or with the authors permission any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/knadh/koanf"
+)
+
+const (
+	USERS = "Users"
+)
+
+// A person who subscribes to feeds and filters.  When any Users are
+// configured, matches are only sent to their subscribers and Pushover.Users
+// only gets error messages.
+type User struct {
+	Name          string   `koanf:"-"`
+	Pushover      string   `koanf:"Pushover"`      // user key
+	Email         string   `koanf:"Email"`         // address for Email notifications
+	Devices       []string `koanf:"Devices"`       // default is all devices
+	Subscriptions []string `koanf:"Subscriptions"` // <feed>, <feed>.<filter> or a glob like `*`
+	QuietHours    string   `koanf:"QuietHours"`    // HH:MM-HH:MM, non-urgent notifications are held
+	Timezone      string   `koanf:"Timezone"`      // for QuietHours, default is local time
+	MaxPerHour    int      `koanf:"MaxPerHour"`    // further notifications are held, 0 is unlimited
+}
+
+// Returns all the configured users sorted by name
+func LoadUsers(konf *koanf.Koanf) ([]User, error) {
+	users := []User{}
+	names := konf.MapKeys(USERS)
+	sort.Strings(names)
+	for _, name := range names {
+		user := User{}
+		if err := konf.Unmarshal(fmt.Sprintf("%s.%s", USERS, name), &user); err != nil {
+			return users, fmt.Errorf("Unable to load %s.%s: %s", USERS, name, err)
+		}
+		user.Name = name
+		user.Devices = splitStrings(user.Devices)
+		user.Subscriptions = splitStrings(user.Subscriptions)
+		users = append(users, user)
+	}
+	return users, nil
+}
+
+// Returns the users subscribed to the feed & filter
+func Subscribers(konf *koanf.Koanf, feedName, filter string) ([]User, error) {
+	users, err := LoadUsers(konf)
+	if err != nil {
+		return users, err
+	}
+	ret := []User{}
+	for _, user := range users {
+		if user.Subscribed(feedName, filter) {
+			ret = append(ret, user)
+		}
+	}
+	return ret, nil
+}
+
+// Returns if the user subscribes to the feed & filter
+func (u User) Subscribed(feedName, filter string) bool {
+	name := feedName
+	if filter != "" {
+		name = fmt.Sprintf("%s.%s", feedName, filter)
+	}
+	for _, sub := range u.Subscriptions {
+		if sub == feedName || sub == name {
+			return true
+		}
+		if ok, _ := path.Match(sub, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns if the given time is within the users quiet hours
+func (u User) InQuietHours(now time.Time) (bool, error) {
+	until, err := quietUntil(u.QuietHours, u.Timezone, now)
+	return !until.IsZero(), err
+}
+
+// Parses HH:MM-HH:MM into the start & end minute of the day
+func parseQuietHours(hours string) (int, int, error) {
+	parts := strings.Split(hours, "-")
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("Invalid QuietHours `%s`, must be HH:MM-HH:MM", hours)
+	}
+	start, err := parseClock(parts[0])
+	if err != nil {
+		return 0, 0, fmt.Errorf("Invalid QuietHours `%s`: %s", hours, err)
+	}
+	end, err := parseClock(parts[1])
+	if err != nil {
+		return 0, 0, fmt.Errorf("Invalid QuietHours `%s`: %s", hours, err)
+	}
+	return start, end, nil
+}
+
+// Parses HH:MM into the minute of the day
+func parseClock(clock string) (int, error) {
+	hm := strings.Split(strings.TrimSpace(clock), ":")
+	if len(hm) != 2 {
+		return 0, fmt.Errorf("invalid time %s, must be HH:MM", clock)
+	}
+	h, err := strconv.Atoi(hm[0])
+	if err != nil || h < 0 || h > 23 {
+		return 0, fmt.Errorf("invalid hour in %s", clock)
+	}
+	m, err := strconv.Atoi(hm[1])
+	if err != nil || m < 0 || m > 59 {
+		return 0, fmt.Errorf("invalid minute in %s", clock)
+	}
+	return h*60 + m, nil
+}
+
+func validateUsers(konf *koanf.Koanf) []string {
+	problems := []string{}
+	users, err := LoadUsers(konf)
+	if err != nil {
+		return append(problems, err.Error())
+	}
+	for _, user := range users {
+		prefix := fmt.Sprintf("%s.%s", USERS, user.Name)
+		if user.Pushover == "" && user.Email == "" {
+			problems = append(problems, fmt.Sprintf("%s: missing Pushover or Email", prefix))
+		}
+		if len(user.Subscriptions) == 0 {
+			problems = append(problems, fmt.Sprintf("%s.Subscriptions: missing", prefix))
+		}
+		for _, sub := range user.Subscriptions {
+			if _, err := path.Match(sub, ""); err != nil {
+				problems = append(problems, fmt.Sprintf("%s.Subscriptions: `%s`: %s", prefix, sub, err))
+			} else if !strings.ContainsAny(sub, "*?[") {
+				feedName := strings.SplitN(sub, ".", 2)[0]
+				if !konf.Exists("Feeds." + feedName) {
+					problems = append(problems, fmt.Sprintf("%s.Subscriptions: unknown feed %s", prefix, feedName))
+				}
+			}
+		}
+		if _, err := user.InQuietHours(time.Now()); err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %s", prefix, err))
+		}
+	}
+	return problems
+}
@@ -0,0 +1,278 @@
+package main
+
+/*
+ * RSS Download Tool
+ * Copyright (c) 2021 Aaron Turner  <aturner at synfin dot net>
+ *
+ * This program is free software: you can redistribute it
+ * and/or modify it under the terms of the GNU General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or with the authors permission any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"text/template"
+	"time"
+
+	"github.com/knadh/koanf"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	WEBHOOKS                = "Webhooks"
+	WEBHOOK_SIGNATURE       = "X-Signature-256" // sha256=<hex HMAC of the body>
+	WEBHOOK_EVENT           = "X-Rss-Event"
+	EVENT_MATCH             = "match"
+	EVENT_DOWNLOADED        = "downloaded"
+	EVENT_DOWNLOAD_FAILED   = "download-failed"
+	EVENT_FEED_ERROR        = "feed-error"
+	WEBHOOK_EVENTS          = "match,downloaded,download-failed,feed-error"
+	DEFAULT_WEBHOOK_METHOD  = http.MethodPost
+	DEFAULT_WEBHOOK_CONTENT = "application/json"
+)
+
+// Sends a HTTP request for each event
+type Webhook struct {
+	Name     string            `koanf:"-"`
+	Url      string            `koanf:"Url"`
+	Method   string            `koanf:"Method"`   // default POST
+	Headers  map[string]string `koanf:"Headers"`  // extra request headers
+	Secret   string            `koanf:"Secret"`   // signs the body with HMAC-SHA256
+	Template string            `koanf:"Template"` // text/template for the body, default is the JSON event
+	Events   []string          `koanf:"Events"`   // which events to send, default all
+	Attempts int               `koanf:"Attempts"` // overrides Retry.Attempts
+}
+
+// The document sent for each event
+type WebhookEvent struct {
+	Event  string        `json:"Event"`
+	Time   time.Time     `json:"Time"`
+	Feed   string        `json:"Feed"`
+	Filter string        `json:"Filter,omitempty"`
+	Entry  *RssFeedEntry `json:"Entry,omitempty"`
+	Target string        `json:"Target,omitempty"`
+	Disk   *DiskStatus   `json:"DiskStatus,omitempty"`
+	Error  string        `json:"Error,omitempty"`
+}
+
+// Returns all the configured webhooks sorted by name
+func LoadWebhooks(konf *koanf.Koanf) ([]Webhook, error) {
+	webhooks := []Webhook{}
+	names := konf.MapKeys(WEBHOOKS)
+	sort.Strings(names)
+	for _, name := range names {
+		webhook := Webhook{}
+		if err := konf.Unmarshal(fmt.Sprintf("%s.%s", WEBHOOKS, name), &webhook); err != nil {
+			return webhooks, fmt.Errorf("Unable to load %s.%s: %s", WEBHOOKS, name, err)
+		}
+		webhook.Name = name
+		webhook.Events = splitStrings(webhook.Events)
+		if webhook.Method == "" {
+			webhook.Method = DEFAULT_WEBHOOK_METHOD
+		}
+		webhooks = append(webhooks, webhook)
+	}
+	return webhooks, nil
+}
+
+// Returns the event for the entry with the disk status of the target it
+// would be downloaded to
+func NewEntryEvent(konf *koanf.Koanf, event string, entry RssFeedEntry, err error) WebhookEvent {
+	e := WebhookEvent{
+		Event:  event,
+		Time:   time.Now(),
+		Feed:   entry.FeedName,
+		Filter: entry.Filter,
+		Entry:  &entry,
+	}
+	if target, disk, err := SelectTarget(konf, entry, nil); err == nil || errors.Is(err, ErrNoSpace) {
+		e.Target = target.Name
+		if target.DiskPath != "" {
+			e.Disk = &disk
+		}
+	}
+	if err != nil {
+		e.Error = err.Error()
+	}
+	return e
+}
+
+// Returns the event for a feed which could not be processed
+func NewFeedErrorEvent(feedName string, err error) WebhookEvent {
+	return WebhookEvent{
+		Event: EVENT_FEED_ERROR,
+		Time:  time.Now(),
+		Feed:  feedName,
+		Error: err.Error(),
+	}
+}
+
+// Records the event for the report and queues it for the webhooks, which
+// are sent by SendPublished() once the cache is unlocked
+func PublishEvent(konf *koanf.Koanf, cache *CacheFile, event WebhookEvent) {
+	cache.published = append(cache.published, event)
+	cache.RecordActivity(konf, event)
+}
+
+// Sends the events published with the cache to the webhooks.  Retrying a
+// webhook can take a while, so call this after Close() so other runs
+// aren't kept waiting for the cache.
+func SendPublished(konf *koanf.Koanf, cache *CacheFile) {
+	for _, event := range cache.published {
+		SendWebhooks(konf, event)
+	}
+	cache.published = []WebhookEvent{}
+}
+
+// Publishes the result of downloading the entry
+func PublishDownload(konf *koanf.Koanf, cache *CacheFile, entry RssFeedEntry, err error) {
+	event := EVENT_DOWNLOADED
+	if err != nil {
+		event = EVENT_DOWNLOAD_FAILED
+	}
+	PublishEvent(konf, cache, NewEntryEvent(konf, event, entry, err))
+}
+
+// Sends the event to all the webhooks which want it.  Failures are logged.
+func SendWebhooks(konf *koanf.Koanf, event WebhookEvent) {
+	webhooks, err := LoadWebhooks(konf)
+	if err != nil {
+		log.WithError(err).Errorf("Unable to send %s webhooks", event.Event)
+		return
+	}
+	for _, webhook := range webhooks {
+		if !webhook.Wants(event.Event) {
+			continue
+		}
+		if err := webhook.Send(konf, event); err != nil {
+			log.WithError(err).Errorf("Unable to send %s webhook %s", event.Event, webhook.Name)
+		}
+	}
+}
+
+// Returns if the webhook is enabled for the event
+func (w Webhook) Wants(event string) bool {
+	if len(w.Events) == 0 {
+		return true
+	}
+	for _, e := range w.Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the request body for the event
+func (w Webhook) Body(event WebhookEvent) ([]byte, error) {
+	if w.Template == "" {
+		return json.Marshal(event)
+	}
+	tmpl, err := template.New(w.Name).Funcs(template.FuncMap{
+		"json": func(v interface{}) (string, error) {
+			b, err := json.Marshal(v)
+			return string(b), err
+		},
+	}).Parse(w.Template)
+	if err != nil {
+		return []byte{}, fmt.Errorf("Invalid Template: %s", err)
+	}
+	var body bytes.Buffer
+	if err = tmpl.Execute(&body, event); err != nil {
+		return []byte{}, fmt.Errorf("Invalid Template: %s", err)
+	}
+	return body.Bytes(), nil
+}
+
+// Returns the HMAC-SHA256 signature of the body
+func (w Webhook) Sign(body []byte) string {
+	mac := hmac.New(sha256.New, []byte(w.Secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Sends the event, retrying transient failures
+func (w Webhook) Send(konf *koanf.Koanf, event WebhookEvent) error {
+	body, err := w.Body(event)
+	if err != nil {
+		return err
+	}
+	retry := LoadRetryPolicy(konf)
+	if w.Attempts > 0 {
+		retry.Attempts = w.Attempts
+	}
+	client := retry.Client()
+	return retry.Do(fmt.Sprintf("Sending webhook %s", w.Name), func() error {
+		req, err := http.NewRequest(w.Method, w.Url, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", DEFAULT_WEBHOOK_CONTENT)
+		req.Header.Set(WEBHOOK_EVENT, event.Event)
+		for k, v := range w.Headers {
+			req.Header.Set(k, v)
+		}
+		if w.Secret != "" {
+			req.Header.Set(WEBHOOK_SIGNATURE, w.Sign(body))
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			return HttpStatusError{
+				Url:        redactUrl(w.Url),
+				StatusCode: resp.StatusCode,
+				Status:     resp.Status,
+			}
+		}
+		log.Debugf("Sent %s webhook %s", event.Event, w.Name)
+		return nil
+	})
+}
+
+func validateWebhooks(konf *koanf.Koanf) []string {
+	problems := []string{}
+	webhooks, err := LoadWebhooks(konf)
+	if err != nil {
+		return append(problems, err.Error())
+	}
+	for _, webhook := range webhooks {
+		prefix := fmt.Sprintf("%s.%s", WEBHOOKS, webhook.Name)
+		if u, err := url.Parse(webhook.Url); webhook.Url == "" {
+			problems = append(problems, fmt.Sprintf("%s.Url: missing", prefix))
+		} else if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			problems = append(problems, fmt.Sprintf("%s.Url: invalid URL %s", prefix, redactUrl(webhook.Url)))
+		}
+		for _, event := range webhook.Events {
+			if !inList(WEBHOOK_EVENTS, event) {
+				problems = append(problems, fmt.Sprintf("%s.Events: invalid event %s, must be one of %s",
+					prefix, event, WEBHOOK_EVENTS))
+			}
+		}
+		sample := RssFeedEntry{FeedName: "feed", Title: "Show.Name.S01E01.1080p"}
+		if _, err := webhook.Body(WebhookEvent{Event: EVENT_MATCH, Entry: &sample}); err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %s", prefix, err))
+		}
+	}
+	return problems
+}
@@ -0,0 +1,83 @@
+package main
+
+/*
+ * RSS Download Tool
+ * Copyright (c) 2021 Aaron Turner  <aturner at synfin dot net>
+ *
+ * This program is free software: you can redistribute it
+ * and/or modify it under the terms of the GNU General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or with the authors permission any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+func TestSendPublished(t *testing.T) {
+	lock := sync.Mutex{}
+	received := []string{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		lock.Lock()
+		defer lock.Unlock()
+		received = append(received, r.Header.Get(WEBHOOK_EVENT))
+		if len(body) == 0 {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	defer server.Close()
+	requests := func() []string {
+		lock.Lock()
+		defer lock.Unlock()
+		return append([]string{}, received...)
+	}
+
+	konf := testKonf(t, map[string]interface{}{
+		"Webhooks.all.Url":       server.URL,
+		"Webhooks.errors.Url":    server.URL + "/errors",
+		"Webhooks.errors.Events": []string{EVENT_FEED_ERROR},
+	})
+	cache := testCache(t)
+	entry := RssFeedEntry{Title: "Show.Name.S01E01.1080p", FeedName: "tv"}
+	PublishEvent(konf, cache, NewEntryEvent(konf, EVENT_MATCH, entry, nil))
+	PublishEvent(konf, cache, NewFeedErrorEvent("tv", errors.New("connection refused")))
+
+	// nothing is sent while we have the cache
+	if got := requests(); len(got) != 0 {
+		t.Fatalf("Webhooks sent before SendPublished(): %v", got)
+	}
+
+	cache.Close()
+	SendPublished(konf, cache)
+	expected := []string{EVENT_MATCH, EVENT_FEED_ERROR, EVENT_FEED_ERROR}
+	got := requests()
+	if len(got) != len(expected) {
+		t.Fatalf("Sent %v, expected %v", got, expected)
+	}
+	for i := range expected {
+		if got[i] != expected[i] {
+			t.Errorf("Sent %v, expected %v", got, expected)
+			break
+		}
+	}
+
+	// and only once
+	SendPublished(konf, cache)
+	if again := requests(); len(again) != len(expected) {
+		t.Errorf("Events were sent again: %v", again)
+	}
+}
@@ -4,19 +4,20 @@ go 1.17
 
 require (
 	github.com/alecthomas/kong v0.7.1
-	github.com/gregdel/pushover v1.1.0
+	github.com/fsnotify/fsnotify v1.4.9
+	github.com/gregdel/pushover v1.3.1
 	github.com/knadh/koanf v1.5.0
 	github.com/mattn/go-colorable v0.1.8
 	github.com/mmcdole/gofeed v1.2.0
 	github.com/sirupsen/logrus v1.8.1
 	golang.org/x/net v0.7.0 // indirect; security
 	golang.org/x/sys v0.5.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
 	github.com/PuerkitoBio/goquery v1.8.0 // indirect
 	github.com/andybalholm/cascadia v1.3.1 // indirect
-	github.com/fsnotify/fsnotify v1.4.9 // indirect
 	github.com/json-iterator/go v1.1.12 // indirect
 	github.com/mattn/go-isatty v0.0.12 // indirect
 	github.com/mitchellh/copystructure v1.2.0 // indirect
@@ -26,5 +27,4 @@ require (
 	github.com/modern-go/concurrent v0.0.0-20180306012644-bacd9c7ef1dd // indirect
 	github.com/modern-go/reflect2 v1.0.2 // indirect
 	golang.org/x/text v0.7.0 // indirect
-	gopkg.in/yaml.v3 v3.0.1 // indirect
 )